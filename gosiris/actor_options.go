@@ -7,14 +7,17 @@ const (
 )
 
 type ActorOptions struct {
-	parent         string
-	remote         bool //Default: false
-	autoclose      bool //Default: false
-	remoteType     string
-	url            string
-	destination    string
-	bufferSize     int //Default: 64
-	defaultWatcher time.Duration
+	parent           string
+	remote           bool //Default: false
+	autoclose        bool //Default: false
+	remoteType       string
+	url              string
+	destination      string
+	bufferSize       int //Default: 64
+	defaultWatcher   time.Duration
+	transportOptions map[string]string
+	labels           map[string]string
+	node             string
 }
 
 //TODO No interface
@@ -35,6 +38,11 @@ type OptionsInterface interface {
 	BufferSize() int
 	SetDefaultWatcher(time.Duration) OptionsInterface
 	DefaultWatcher() time.Duration
+	SetTransportOption(string, string) OptionsInterface
+	TransportOptions() map[string]string
+	SetLabel(string, string) OptionsInterface
+	Labels() map[string]string
+	Node() string
 }
 
 func (options *ActorOptions) SetRemote(b bool) OptionsInterface {
@@ -107,3 +115,33 @@ func (options *ActorOptions) SetDefaultWatcher(d time.Duration) OptionsInterface
 func (options *ActorOptions) DefaultWatcher() time.Duration {
 	return options.defaultWatcher
 }
+
+func (options *ActorOptions) SetTransportOption(key string, value string) OptionsInterface {
+	if options.transportOptions == nil {
+		options.transportOptions = make(map[string]string)
+	}
+	options.transportOptions[key] = value
+	return options
+}
+
+func (options *ActorOptions) TransportOptions() map[string]string {
+	return options.transportOptions
+}
+
+//Labels are published with the actor in the registry, e.g. role=billing
+func (options *ActorOptions) SetLabel(key string, value string) OptionsInterface {
+	if options.labels == nil {
+		options.labels = make(map[string]string)
+	}
+	options.labels[key] = value
+	return options
+}
+
+func (options *ActorOptions) Labels() map[string]string {
+	return options.labels
+}
+
+//Identifier of the actor system hosting an actor discovered through the registry
+func (options *ActorOptions) Node() string {
+	return options.node
+}
@@ -62,13 +62,13 @@ func (ref ActorRef) Tell(context Context, messageType string, data interface{},
 		span = startZipkinSpan(sender.Name(), messageType)
 	}
 
-	dispatch(actor.actor.getDataChan(), messageType, data, &ref, sender, actor.options, span)
+	err = dispatch(actor.actor.getDataChan(), messageType, data, &ref, sender, actor.options, span)
 
 	if span != nil {
 		stopZipkinSpan(span)
 	}
 
-	return nil
+	return err
 }
 
 func (ref ActorRef) Repeat(messageType string, d time.Duration, data interface{}, sender ActorRefInterface) (chan struct{}, error) {
@@ -0,0 +1,533 @@
+package gosiris
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	clusterGossipPath         = "/gosiris/cluster/gossip"
+	clusterGossipTimeout      = 2 * time.Second
+	clusterTombstoneTTL       = 10 * time.Minute
+	defaultGossipInterval     = time.Second
+	defaultPhiThreshold       = 8
+	defaultClusterRemovalTime = 30 * time.Second
+)
+
+//Status of a member as seen by the local node
+const (
+	MemberStatusUp          = "up"
+	MemberStatusUnreachable = "unreachable"
+	MemberStatusLeft        = "left"    //Removed after leaving the cluster
+	MemberStatusRemoved     = "removed" //Removed after being unreachable for too long
+)
+
+var clusterInstance *cluster
+
+type ClusterOptions struct {
+	Address           string            //host:port the gossip endpoint listens on (port 0 for any free port)
+	AdvertisedAddress string            //host:port the other members reach this node at (default: Address)
+	Seeds             []string          //Addresses of the members contacted to join the cluster
+	GossipInterval    time.Duration     //Default: 1s
+	PhiThreshold      float64           //Suspicion level above which a member is unreachable (default: 8)
+	RemovalTime       time.Duration     //Time a member stays unreachable before being removed (default: 30s)
+	Metadata          map[string]string //Published with the member, e.g. its roles
+}
+
+//A member is an actor system of the cluster, identified by its node id.
+//The incarnation tells two runs of the same node apart, the heartbeat is incremented at each gossip round.
+type Member struct {
+	Id          string            `json:"id"`
+	Address     string            `json:"address"`
+	Incarnation int64             `json:"incarnation"`
+	Heartbeat   uint64            `json:"heartbeat"`
+	Status      string            `json:"status"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type clusterMember struct {
+	Member
+	detector *phiAccrualDetector
+	since    time.Time //Unreachable or removed since
+}
+
+type clusterEvent struct {
+	messageType string
+	member      Member
+	subscriber  ActorRefInterface //Nil if the event is published to every subscriber
+}
+
+type clusterGossip struct {
+	Members []Member `json:"members"`
+}
+
+//Membership of the actor systems forming a cluster. Each node joins through the seeds, then gossips its view
+//of the members with a random one at each interval (push-pull over HTTP). The members whose heartbeat is not
+//received anymore are detected by a phi accrual failure detector, then removed if they stay unreachable.
+//Reachability is local to each node: only the joins and the leaves are gossiped. A removed member is still
+//contacted until its tombstone expires and joins again once it gossips a newer heartbeat itself (e.g. once a
+//partition heals), or with a new incarnation once restarted.
+type cluster struct {
+	options     ClusterOptions
+	self        Member
+	members     map[string]*clusterMember
+	server      *http.Server
+	client      *http.Client
+	subscribers map[string]ActorRefInterface
+	listeners   []func(string, Member)
+	events      []clusterEvent
+	signal      chan struct{}
+	done        chan struct{}
+	mutex       sync.Mutex
+}
+
+//Returns the cluster the actor system is a member of, nil if ClusterOptions.Address is not configured
+func Cluster() *cluster {
+	return clusterInstance
+}
+
+func newCluster(options ClusterOptions, id string) (*cluster, error) {
+	if options.GossipInterval == 0 {
+		options.GossipInterval = defaultGossipInterval
+	}
+	if options.PhiThreshold == 0 {
+		options.PhiThreshold = defaultPhiThreshold
+	}
+	if options.RemovalTime == 0 {
+		options.RemovalTime = defaultClusterRemovalTime
+	}
+
+	listener, err := net.Listen("tcp", options.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on cluster address %v: %v", options.Address, err)
+	}
+
+	address := options.AdvertisedAddress
+	if address == "" {
+		address = listener.Addr().String()
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range options.Metadata {
+		metadata[k] = v
+	}
+
+	c := &cluster{
+		options: options,
+		self: Member{
+			Id:          id,
+			Address:     address,
+			Incarnation: time.Now().UnixNano(),
+			Status:      MemberStatusUp,
+			Metadata:    metadata,
+		},
+		members:     make(map[string]*clusterMember),
+		client:      &http.Client{Timeout: clusterGossipTimeout},
+		subscribers: make(map[string]ActorRefInterface),
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(clusterGossipPath, c.serveGossip)
+	c.server = &http.Server{Handler: mux}
+	go c.server.Serve(listener)
+
+	go c.run()
+	go c.dispatchEvents()
+
+	InfoLogger.Printf("Cluster member %v started on %v", id, address)
+
+	return c, nil
+}
+
+func (c *cluster) Self() Member {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.self
+}
+
+//Returns the members up or unreachable, this node included, sorted by id
+func (c *cluster) Members() []Member {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	members := []Member{c.self}
+	for _, m := range c.members {
+		if m.Status == MemberStatusUp || m.Status == MemberStatusUnreachable {
+			members = append(members, m.Member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id < members[j].Id
+	})
+
+	return members
+}
+
+//Tells the membership events to an actor (GosirisMsgMemberUp, GosirisMsgMemberUnreachable and GosirisMsgMemberRemoved
+//with the member as data), starting with a GosirisMsgMemberUp for each member already up
+func (c *cluster) Subscribe(actorRef ActorRefInterface) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subscribers[actorRef.Name()] = actorRef
+
+	c.enqueue(clusterEvent{GosirisMsgMemberUp, c.self, actorRef})
+	for _, m := range c.members {
+		if m.Status == MemberStatusUp {
+			c.enqueue(clusterEvent{GosirisMsgMemberUp, m.Member, actorRef})
+		}
+	}
+}
+
+func (c *cluster) Unsubscribe(actorRef ActorRefInterface) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.subscribers, actorRef.Name())
+}
+
+//Updates the metadata of this node, gossiped with its next heartbeat
+func (c *cluster) SetMetadata(key string, value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	metadata := make(map[string]string)
+	for k, v := range c.self.Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+	c.self.Metadata = metadata
+	c.self.Heartbeat++
+}
+
+//Leaves the cluster: the other members are told right away, instead of detecting the node as unreachable
+func (c *cluster) Leave() {
+	c.mutex.Lock()
+	c.self.Status = MemberStatusLeft
+	c.self.Heartbeat++
+	gossip := c.snapshot()
+	var targets []string
+	for _, m := range c.members {
+		if m.Status == MemberStatusUp {
+			targets = append(targets, m.Address)
+		}
+	}
+	c.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			c.gossip(target, gossip)
+		}(target)
+	}
+	wg.Wait()
+
+	c.stop()
+
+	InfoLogger.Printf("Cluster member %v left", c.self.Id)
+}
+
+func (c *cluster) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+		close(c.done)
+	}
+
+	c.server.Close()
+}
+
+//Registers a function called with the membership events, in order
+func (c *cluster) subscribe(f func(string, Member)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.listeners = append(c.listeners, f)
+}
+
+//Whether a node has been removed from the cluster, its actors being ignored
+func (c *cluster) removed(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	m, exists := c.members[id]
+
+	return exists && (m.Status == MemberStatusLeft || m.Status == MemberStatusRemoved)
+}
+
+func (c *cluster) run() {
+	t := time.NewTicker(c.options.GossipInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			c.tick()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//Increments the heartbeat of this node, checks the other members then gossips with one of them.
+//While no other member is known, the gossip is sent to every seed.
+func (c *cluster) tick() {
+	now := time.Now()
+
+	c.mutex.Lock()
+	c.self.Heartbeat++
+
+	var targets, probes []string
+	for id, m := range c.members {
+		switch m.Status {
+		case MemberStatusUp:
+			if m.detector.phi(now) > c.options.PhiThreshold {
+				m.Status = MemberStatusUnreachable
+				m.since = now
+				c.publish(GosirisMsgMemberUnreachable, m.Member)
+			}
+		case MemberStatusUnreachable:
+			if now.Sub(m.since) > c.options.RemovalTime {
+				m.Status = MemberStatusRemoved
+				m.since = now
+				c.publish(GosirisMsgMemberRemoved, m.Member)
+				continue
+			}
+		default:
+			if now.Sub(m.since) > clusterTombstoneTTL {
+				delete(c.members, id)
+			} else if m.Status == MemberStatusRemoved {
+				probes = append(probes, m.Address)
+			}
+			continue
+		}
+		targets = append(targets, m.Address)
+	}
+
+	if len(targets) == 0 {
+		for _, seed := range c.options.Seeds {
+			if seed != c.self.Address {
+				targets = append(targets, seed)
+			}
+		}
+	} else {
+		targets = []string{targets[rand.Intn(len(targets))]}
+	}
+	targets = append(targets, probes...)
+
+	gossip := c.snapshot()
+	c.mutex.Unlock()
+
+	for _, target := range targets {
+		go c.gossip(target, gossip)
+	}
+}
+
+//The members unreachable are gossiped as up, the receivers ignoring a heartbeat they already know.
+//The members left are gossiped until their tombstone expires, so that they are not added again.
+func (c *cluster) snapshot() clusterGossip {
+	gossip := clusterGossip{Members: []Member{c.self}}
+	for _, m := range c.members {
+		switch m.Status {
+		case MemberStatusUp, MemberStatusUnreachable:
+			member := m.Member
+			member.Status = MemberStatusUp
+			gossip.Members = append(gossip.Members, member)
+		case MemberStatusLeft:
+			gossip.Members = append(gossip.Members, m.Member)
+		}
+	}
+
+	return gossip
+}
+
+func (c *cluster) gossip(address string, gossip clusterGossip) {
+	body, _ := json.Marshal(gossip)
+	resp, err := c.client.Post("http://"+address+clusterGossipPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		ErrorLogger.Printf("Cluster gossip with %v failed: %v", address, resp.Status)
+		return
+	}
+
+	reply := clusterGossip{}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		ErrorLogger.Printf("Invalid cluster gossip from %v: %v", address, err)
+		return
+	}
+	c.merge(reply)
+}
+
+func (c *cluster) serveGossip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gossip := clusterGossip{}
+	err := json.NewDecoder(r.Body).Decode(&gossip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.merge(gossip)
+
+	c.mutex.Lock()
+	reply := c.snapshot()
+	c.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (c *cluster) merge(gossip clusterGossip) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	//The first member gossiped is the sender
+	var sender string
+	if len(gossip.Members) != 0 {
+		sender = gossip.Members[0].Id
+	}
+
+	for _, m := range gossip.Members {
+		if m.Id == c.self.Id {
+			continue
+		}
+
+		existing, known := c.members[m.Id]
+		switch {
+		case !known:
+			if m.Status == MemberStatusLeft {
+				c.members[m.Id] = &clusterMember{Member: m, since: now}
+				continue
+			}
+			c.join(m, now)
+		case existing.Status == MemberStatusLeft || existing.Status == MemberStatusRemoved:
+			//A removed member is only rejoined on a heartbeat of its own, the other members possibly gossiping
+			//the last heartbeat they received before it became unreachable
+			rejoined := existing.Status == MemberStatusRemoved && m.Id == sender && newer(m, existing.Member)
+			if m.Status == MemberStatusUp && (m.Incarnation > existing.Incarnation || rejoined) {
+				c.join(m, now)
+			}
+		case !newer(m, existing.Member):
+			//Heartbeat already known
+		case m.Status == MemberStatusLeft:
+			existing.Member = m
+			existing.since = now
+			c.publish(GosirisMsgMemberRemoved, m)
+		default:
+			if m.Incarnation != existing.Incarnation {
+				existing.detector = c.newDetector(now)
+			} else {
+				existing.detector.heartbeat(now)
+			}
+			existing.Address = m.Address
+			existing.Incarnation = m.Incarnation
+			existing.Heartbeat = m.Heartbeat
+			existing.Metadata = m.Metadata
+
+			if existing.Status == MemberStatusUnreachable {
+				existing.Status = MemberStatusUp
+				c.publish(GosirisMsgMemberUp, existing.Member)
+			}
+		}
+	}
+}
+
+func (c *cluster) join(m Member, now time.Time) {
+	m.Status = MemberStatusUp
+	c.members[m.Id] = &clusterMember{
+		Member:   m,
+		detector: c.newDetector(now),
+	}
+	c.publish(GosirisMsgMemberUp, m)
+}
+
+//A heartbeat may be received a few rounds late, the gossip going through other members
+func (c *cluster) newDetector(now time.Time) *phiAccrualDetector {
+	return newPhiAccrualDetector(c.options.GossipInterval, 3*c.options.GossipInterval, now)
+}
+
+func newer(a Member, b Member) bool {
+	return a.Incarnation > b.Incarnation || (a.Incarnation == b.Incarnation && a.Heartbeat > b.Heartbeat)
+}
+
+func (c *cluster) publish(messageType string, member Member) {
+	InfoLogger.Printf("Cluster member %v: %v", member.Id, messageType)
+
+	c.enqueue(clusterEvent{messageType, member, nil})
+}
+
+//The events are queued without blocking, then dispatched in order by a single goroutine
+func (c *cluster) enqueue(event clusterEvent) {
+	c.events = append(c.events, event)
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cluster) dispatchEvents() {
+	for {
+		select {
+		case <-c.signal:
+		case <-c.done:
+			return
+		}
+
+		c.mutex.Lock()
+		events := c.events
+		c.events = nil
+		listeners := c.listeners
+		subscribers := make([]ActorRefInterface, 0, len(c.subscribers))
+		for _, s := range c.subscribers {
+			subscribers = append(subscribers, s)
+		}
+		c.mutex.Unlock()
+
+		for _, e := range events {
+			if e.subscriber != nil {
+				e.subscriber.Tell(EmptyContext, e.messageType, e.member, e.subscriber)
+				continue
+			}
+
+			for _, f := range listeners {
+				f(e.messageType, e.member)
+			}
+			for _, s := range subscribers {
+				s.Tell(EmptyContext, e.messageType, e.member, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package gosiris
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	phiAccrualWindow = 100 //Number of heartbeat intervals the distribution is computed from
+)
+
+//Phi accrual failure detector (Hayashibara et al.): rather than a boolean, the suspicion level of a member
+//grows with the time elapsed since its last heartbeat, relative to the distribution of the previous intervals.
+//A phi of 1 means a 10% chance of being wrong when suspecting the member, a phi of 2 a 1% chance and so on.
+type phiAccrualDetector struct {
+	intervals       []float64 //Milliseconds
+	last            time.Time
+	acceptablePause float64
+	minStdDev       float64
+}
+
+//The history starts with an estimate based on the expected interval, so that a member never heard of again is suspected too
+func newPhiAccrualDetector(interval time.Duration, acceptablePause time.Duration, now time.Time) *phiAccrualDetector {
+	mean := milliseconds(interval)
+	stdDev := mean / 4
+
+	return &phiAccrualDetector{
+		intervals:       []float64{mean - stdDev, mean + stdDev},
+		last:            now,
+		acceptablePause: milliseconds(acceptablePause),
+		minStdDev:       mean / 2,
+	}
+}
+
+func (detector *phiAccrualDetector) heartbeat(now time.Time) {
+	detector.intervals = append(detector.intervals, milliseconds(now.Sub(detector.last)))
+	if len(detector.intervals) > phiAccrualWindow {
+		detector.intervals = detector.intervals[1:]
+	}
+	detector.last = now
+}
+
+//Uses the logistic approximation of the cumulative normal distribution
+func (detector *phiAccrualDetector) phi(now time.Time) float64 {
+	mean, variance := 0.0, 0.0
+	for _, interval := range detector.intervals {
+		mean += interval
+	}
+	mean /= float64(len(detector.intervals))
+	for _, interval := range detector.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(detector.intervals))
+
+	mean += detector.acceptablePause
+	stdDev := math.Max(math.Sqrt(variance), detector.minStdDev)
+
+	elapsed := milliseconds(now.Sub(detector.last))
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
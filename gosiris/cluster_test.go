@@ -0,0 +1,288 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func clusterTestOptions(seeds ...string) ClusterOptions {
+	return ClusterOptions{
+		Address:        "127.0.0.1:0",
+		Seeds:          seeds,
+		GossipInterval: 20 * time.Millisecond,
+		RemovalTime:    200 * time.Millisecond,
+	}
+}
+
+func newClusterTestNode(t *testing.T, id string, seeds ...string) *cluster {
+	c, err := newCluster(clusterTestOptions(seeds...), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+//Membership events recorded as "id messageType", in any order
+type clusterEvents struct {
+	events []string
+	mutex  sync.Mutex
+}
+
+func (events *clusterEvents) record(messageType string, member Member) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	events.events = append(events.events, member.Id+" "+messageType)
+}
+
+//Waits for an event, consumed so that it can be expected again
+func (events *clusterEvents) expect(t *testing.T, expected string) {
+	for i := 0; i < 500; i++ {
+		events.mutex.Lock()
+		for j, e := range events.events {
+			if e == expected {
+				events.events = append(events.events[:j], events.events[j+1:]...)
+				events.mutex.Unlock()
+				return
+			}
+		}
+		events.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Event %v not received", expected)
+}
+
+func recordClusterEvents(c *cluster) *clusterEvents {
+	events := &clusterEvents{}
+	c.subscribe(events.record)
+
+	return events
+}
+
+func TestPhiAccrualDetector(t *testing.T) {
+	t.Log("Starting phi accrual detector test")
+
+	now := time.Now()
+	detector := newPhiAccrualDetector(100*time.Millisecond, 0, now)
+	for i := 0; i < 20; i++ {
+		now = now.Add(100 * time.Millisecond)
+		detector.heartbeat(now)
+	}
+
+	previous := 0.0
+	for _, elapsed := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond} {
+		phi := detector.phi(now.Add(elapsed))
+		if phi < previous {
+			t.Errorf("Phi decreasing after %v: %v < %v", elapsed, phi, previous)
+		}
+		previous = phi
+	}
+
+	if phi := detector.phi(now.Add(100 * time.Millisecond)); phi > 1 {
+		t.Errorf("Member suspected on time: phi %v", phi)
+	}
+	if phi := detector.phi(now.Add(time.Second)); phi < defaultPhiThreshold {
+		t.Errorf("Member not suspected after 10 missed heartbeats: phi %v", phi)
+	}
+
+	//The acceptable pause delays the suspicion
+	paused := newPhiAccrualDetector(100*time.Millisecond, time.Second, now)
+	if phi := paused.phi(now.Add(time.Second)); phi > 1 {
+		t.Errorf("Member suspected during an acceptable pause: phi %v", phi)
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	t.Log("Starting cluster membership test")
+
+	seed := newClusterTestNode(t, "seed")
+	defer seed.stop()
+	events := recordClusterEvents(seed)
+
+	node1 := newClusterTestNode(t, "node1", seed.Self().Address)
+	defer node1.stop()
+	node2 := newClusterTestNode(t, "node2", seed.Self().Address)
+	defer node2.stop()
+	node2Events := recordClusterEvents(node2)
+
+	events.expect(t, "node1 "+GosirisMsgMemberUp)
+	events.expect(t, "node2 "+GosirisMsgMemberUp)
+	//node1 is known by node2 through the gossip, without having contacted it
+	node2Events.expect(t, "node1 "+GosirisMsgMemberUp)
+
+	//The views of the members converge
+	for _, c := range []*cluster{seed, node1, node2} {
+		for i := 0; ; i++ {
+			members := c.Members()
+			if len(members) == 3 && members[0].Id == "node1" && members[2].Id == "seed" {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("Unexpected members of %v: %v", c.Self().Id, members)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	//The metadata are gossiped with the heartbeats
+	node1.SetMetadata("role", "billing")
+	for i := 0; ; i++ {
+		if members := node2.Members(); members[0].Metadata["role"] == "billing" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Metadata not gossiped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//node1 crashes
+	node1.stop()
+	events.expect(t, "node1 "+GosirisMsgMemberUnreachable)
+	events.expect(t, "node1 "+GosirisMsgMemberRemoved)
+	node2Events.expect(t, "node1 "+GosirisMsgMemberRemoved)
+
+	if members := seed.Members(); len(members) != 2 {
+		t.Errorf("Unexpected members after the removal: %v", members)
+	}
+	if !seed.removed("node1") {
+		t.Errorf("node1 not removed")
+	}
+
+	//node1 restarts with a new incarnation
+	restarted := newClusterTestNode(t, "node1", seed.Self().Address)
+	defer restarted.stop()
+	events.expect(t, "node1 "+GosirisMsgMemberUp)
+
+	//node2 leaves
+	node2.Leave()
+	events.expect(t, "node2 "+GosirisMsgMemberRemoved)
+	for _, m := range seed.Members() {
+		if m.Id == "node2" {
+			t.Errorf("node2 still a member after leaving")
+		}
+	}
+}
+
+func TestClusterRemovesActors(t *testing.T) {
+	t.Log("Starting cluster actors removal test")
+
+	err := InitActorSystem(SystemOptions{
+		ActorSystemName: "ClusterSystem",
+		RegistryUrl:     "mem://TestClusterRemovesActors",
+		NodeId:          "clusterNode",
+		ClusterOptions:  clusterTestOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseActorSystem()
+
+	events := &clusterEvents{}
+	subscriber := new(Actor)
+	for _, messageType := range []string{GosirisMsgMemberUp, GosirisMsgMemberUnreachable, GosirisMsgMemberRemoved} {
+		messageType := messageType
+		subscriber.React(messageType, func(context Context) {
+			events.record(messageType, context.Data.(Member))
+		})
+	}
+	defer subscriber.Close()
+	ActorSystem().RegisterActor("clusterSubscriber", subscriber, nil)
+	subscriberRef, _ := ActorSystem().ActorOf("clusterSubscriber")
+	Cluster().Subscribe(subscriberRef)
+	events.expect(t, "clusterNode "+GosirisMsgMemberUp)
+
+	//Another node of the cluster registers an actor
+	node := newClusterTestNode(t, "otherNode", Cluster().Self().Address)
+	defer node.stop()
+	events.expect(t, "otherNode "+GosirisMsgMemberUp)
+
+	record, _ := json.Marshal(registryRecord{
+		Version:     registryRecordVersion,
+		RemoteType:  Unix,
+		Url:         t.TempDir() + "/billing.sock",
+		Destination: "billing",
+		Node:        "otherNode",
+	})
+	memoryStoreOf("TestClusterRemovesActors").set("ClusterSystem/clusterBilling", string(record))
+
+	discovered := func(name string, expected bool) {
+		for i := 0; i < 100; i++ {
+			_, err := ActorSystem().ActorOf(name)
+			if (err == nil) == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Actor %v discovered: %v expected", name, expected)
+	}
+	discovered("clusterBilling", true)
+
+	//The node crashes while its entry is still in the registry
+	node.stop()
+	events.expect(t, "otherNode "+GosirisMsgMemberUnreachable)
+	events.expect(t, "otherNode "+GosirisMsgMemberRemoved)
+	discovered("clusterBilling", false)
+
+	//The entries of a removed node are ignored
+	memoryStoreOf("TestClusterRemovesActors").set("ClusterSystem/clusterShipping", string(record))
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ActorSystem().ActorOf("clusterShipping"); err == nil {
+		t.Errorf("Actor of a removed node discovered")
+	}
+}
+
+func TestClusterRejoin(t *testing.T) {
+	t.Log("Starting cluster rejoin test")
+
+	err := InitActorSystem(SystemOptions{
+		ActorSystemName: "ClusterSystem",
+		RegistryUrl:     "mem://TestClusterRejoin",
+		NodeId:          "rejoinNode",
+		ClusterOptions:  clusterTestOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseActorSystem()
+	events := recordClusterEvents(Cluster())
+
+	node := newClusterTestNode(t, "pausedNode", Cluster().Self().Address)
+	defer node.stop()
+	events.expect(t, "pausedNode "+GosirisMsgMemberUp)
+
+	record, _ := json.Marshal(registryRecord{
+		Version:     registryRecordVersion,
+		RemoteType:  Unix,
+		Url:         t.TempDir() + "/billing.sock",
+		Destination: "billing",
+		Node:        "pausedNode",
+	})
+	memoryStoreOf("TestClusterRejoin").set("ClusterSystem/rejoinBilling", string(record))
+	for i := 0; ; i++ {
+		if _, err := ActorSystem().ActorOf("rejoinBilling"); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Actor not discovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//The node stops gossiping long enough to be removed, then resumes with the same incarnation
+	node.mutex.Lock()
+	events.expect(t, "pausedNode "+GosirisMsgMemberRemoved)
+	if _, err := ActorSystem().ActorOf("rejoinBilling"); err == nil {
+		t.Errorf("Actor of a removed node not removed")
+	}
+	node.mutex.Unlock()
+
+	//Its actors are resolved again from the registry once it rejoins
+	events.expect(t, "pausedNode "+GosirisMsgMemberUp)
+	if _, err := ActorSystem().ActorOf("rejoinBilling"); err != nil {
+		t.Errorf("Actor of a rejoined node not resolved again: %v", err)
+	}
+}
@@ -20,6 +20,22 @@ const (
 	GosirisMsgHeartbeatRequest = "gosirisHeartbeatRequest"
 	GosirisMsgHeartbeatReply   = "gosirisHeartbeatReply"
 
+	//Cluster membership events, the data being the member
+	GosirisMsgMemberUp          = "gosirisMemberUp"
+	GosirisMsgMemberUnreachable = "gosirisMemberUnreachable"
+	GosirisMsgMemberRemoved     = "gosirisMemberRemoved"
+
+	//Message forwarded to the shard region of another node, and messages exchanged with the coordinator of the shards
+	GosirisMsgShardEnvelope = "gosirisShardEnvelope"
+	GosirisMsgShardRegister = "gosirisShardRegister"
+	GosirisMsgShardGetHome  = "gosirisShardGetHome"
+	GosirisMsgShardHome     = "gosirisShardHome"
+	GosirisMsgShardHandOff  = "gosirisShardHandOff"
+	GosirisMsgShardStopped  = "gosirisShardStopped"
+
+	//Message published to the mediator of another node
+	GosirisMsgPublish = "gosirisPublish"
+
 	jsonMessageType = "messageType"
 	jsonData        = "data"
 	jsonSender      = "sender"
@@ -27,6 +43,32 @@ const (
 	jsonTracing     = "tracing"
 )
 
+//Data implementing Keyed are routed according to their key by the transports supporting it (e.g. Kafka partitions)
+type Keyed interface {
+	Key() string
+}
+
+//Built-in key extractors
+const (
+	KeyedExtractor  = "keyed"  //Key of the data implementing Keyed
+	SenderExtractor = "sender" //Name of the sender
+)
+
+var keyExtractors = map[string]func(Context) string{
+	KeyedExtractor: func(context Context) string {
+		if k, ok := context.Data.(Keyed); ok {
+			return k.Key()
+		}
+		return ""
+	},
+	SenderExtractor: func(context Context) string {
+		if context.Sender == nil {
+			return ""
+		}
+		return context.Sender.Name()
+	},
+}
+
 type Context struct {
 	MessageType string
 	Data        interface{}
@@ -65,12 +107,14 @@ func (context *Context) UnmarshalJSON(b []byte) error {
 	}
 	context.Self = selfAssociation.actorRef
 
+	//The sender may be unknown to this actor system (e.g. a gateway or a temporary actor)
 	sender := m[jsonSender].(string)
 	senderAssociation, err := ActorSystem().actor(sender)
 	if err != nil {
-		return err
+		context.Sender = newActorRef(sender)
+	} else {
+		context.Sender = senderAssociation.actorRef
 	}
-	context.Sender = senderAssociation.actorRef
 
 	if value, exists := m[jsonTracing]; exists {
 		if value != nil {
@@ -113,7 +157,15 @@ func dispatch(channel chan Context, messageType string, data interface{}, receiv
 			return err
 		}
 
-		d.Send(options.Destination(), json)
+		if c, ok := d.(contextTransport); ok {
+			err = c.SendContext(options.Destination(), m, json)
+		} else {
+			err = d.Send(options.Destination(), json)
+		}
+		if err != nil {
+			ErrorLogger.Printf("Failed to dispatch to remote channel %v: %v", options.Destination(), err)
+			return err
+		}
 		InfoLogger.Printf("Context dispatched to remote channel %v", options.Destination())
 	}
 
@@ -150,3 +202,65 @@ func receive(actor actorInterface, options OptionsInterface) {
 		d.Receive(options.Destination())
 	}
 }
+
+//Mailbox of a remote actor served by a transport receiving from several connections at once (e.g. gRPC, Unix domain sockets),
+//its messages being invoked one at a time by a single receive loop like those of a local actor
+type remoteMailbox struct {
+	messages chan Context
+	done     chan struct{}
+}
+
+func newRemoteMailbox() *remoteMailbox {
+	m := &remoteMailbox{
+		messages: make(chan Context, defaultBufferSize),
+		done:     make(chan struct{}),
+	}
+	go m.receive()
+
+	return m
+}
+
+func (m *remoteMailbox) receive() {
+	for {
+		select {
+		case message := <-m.messages:
+			err := invoke(message)
+			if err != nil {
+				ErrorLogger.Printf("Failed to invoke %v on %v: %v", message.MessageType, message.Self.Name(), err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+//Enqueues a message, waiting for room in the mailbox
+func (m *remoteMailbox) post(message Context) error {
+	select {
+	case m.messages <- message:
+		return nil
+	case <-m.done:
+		return fmt.Errorf("mailbox of %v closed", message.Self.Name())
+	}
+}
+
+func (m *remoteMailbox) close() {
+	close(m.done)
+}
+
+//Invokes a message received from a transport, the panic of a reaction being returned as an error
+func invoke(message Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ErrorLogger.Printf("Invoke recovered in %v", r)
+			err = fmt.Errorf("invoke error: %v", r)
+		}
+	}()
+
+	return ActorSystem().Invoke(message)
+}
+
+//Registers a function extracting the routing key of a message, referenced by name in the transport options
+func RegisterKeyExtractor(name string, f func(Context) string) {
+	keyExtractors[name] = f
+}
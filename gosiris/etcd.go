@@ -2,157 +2,603 @@ package gosiris
 
 import (
 	"context"
-	"github.com/coreos/etcd/client"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	actors_configuration = "/gosiris/actor/"
-	prefix               = "gosiris://"
-	delimiter            = "#"
-	action_delete        = "delete"
-	action_set           = "set"
+	etcdDialTimeout    = 5 * time.Second
+	etcdRequestTimeout = 5 * time.Second
+	defaultEtcdTTL     = 10
+	etcdMigrationKey   = "/gosiris/migration/records" //Set once the legacy entries have been migrated
 )
 
+//The actors registered by an actor system are attached to its lease, kept alive as long as the system is running.
+//If the system dies, the lease expires and etcd deletes its actors.
+//The elections are stored under /gosiris/election/<namespace>/<election>/, each candidate with a lease of its own.
 type etcdClient struct {
-	api client.KeysAPI
+	registryNamespace
+	client   *clientv3.Client
+	ttl      int64
+	lease    clientv3.LeaseID
+	actors   map[string]string
+	revision int64             //Owned by the watch once started
+	entries  map[string]string //Owned by the watch once started
+	watching bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
 }
 
-func (etcdClient *etcdClient) Configure(url ...string) error {
-	cfg := client.Config{
-		Endpoints:               url,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+func init() {
+	registerRegistry("etcd", newEtcdClient)
+	registerRegistry("http", newEtcdClient)
+	registerRegistry("https", newEtcdClient)
+}
+
+func newEtcdClient() registryInterface {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &etcdClient{
+		ttl:    defaultEtcdTTL,
+		actors: make(map[string]string),
+		ctx:    ctx,
+		cancel: cancel,
 	}
+}
 
-	c, err := client.New(cfg)
+//Accepts the etcd endpoints (http://etcd:2379) or an etcd url listing them (etcd://etcd1:2379,etcd2:2379).
+//The ttl parameter sets the lease time to live in seconds, e.g. etcd://etcd:2379?ttl=5
+func (etcdClient *etcdClient) Configure(urls ...string) error {
+	endpoints, ttl, err := etcdEndpoints(urls)
+	if err != nil {
+		return err
+	}
+	if ttl != 0 {
+		etcdClient.ttl = ttl
+	}
+
+	etcdClient.client, err = clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+	})
 	if err != nil {
 		ErrorLogger.Printf("etcd connection error %v", err)
 		return err
 	}
-	etcdClient.api = client.NewKeysAPI(c)
-	etcdClient.createDir(actors_configuration)
+
+	err = etcdClient.grant()
+	if err != nil {
+		ErrorLogger.Printf("etcd lease error %v", err)
+		etcdClient.client.Close()
+		return err
+	}
+
+	go etcdClient.keepAlive()
+
+	err = etcdClient.migrate()
+	if err != nil {
+		ErrorLogger.Printf("etcd migration of the legacy entries failed, retried at the next start: %v", err)
+	}
 
 	return nil
 }
 
-func (etcdClient *etcdClient) Close() {
-}
+//The entries written by gosiris before the records were versioned are stored under /gosiris/actor/<actor>,
+//once imported from the etcd v2 store (etcdctl migrate). They are migrated once to versioned records under
+//the namespace of the first actor system started, each entry being migrated by a single actor system.
+func (etcdClient *etcdClient) migrate() error {
+	ctx, cancel := context.WithTimeout(etcdClient.ctx, etcdRequestTimeout)
+	defer cancel()
 
-func (etcdClient *etcdClient) Watch(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
-	w := etcdClient.api.Watcher(actors_configuration, &client.WatcherOptions{
-		AfterIndex: 0,
-		Recursive:  true,
-	})
+	resp, err := etcdClient.client.Get(ctx, etcdMigrationKey)
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 {
+		return nil
+	}
 
-	for {
-		r, err := w.Next(context.Background())
+	resp, err = etcdClient.client.Get(ctx, actors_configuration, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range resp.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), actors_configuration)
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(string(kv.Value), "{") {
+			continue
+		}
 
+		record, err := decodeLegacyRegistryRecord(name, string(kv.Value))
+		if err != nil {
+			ErrorLogger.Printf("Legacy entry not migrated: %v", err)
+			continue
+		}
+		record.Version = registryRecordVersion
+		record.Registered = time.Now().UTC()
+		v, _ := json.Marshal(record)
+
+		//An entry registered meanwhile under the namespace supersedes the legacy one
+		k := etcdClient.key(name)
+		txn, err := etcdClient.client.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(k), "=", 0),
+		).Then(
+			clientv3.OpPut(k, string(v)),
+			clientv3.OpDelete(string(kv.Key)),
+		).Else(
+			clientv3.OpDelete(string(kv.Key)),
+		).Commit()
 		if err != nil {
-			ErrorLogger.Printf("etcd watch error: %v", err)
 			return err
 		}
+		if txn.Succeeded {
+			InfoLogger.Printf("Legacy entry of actor %v migrated to %v", name, k)
+		}
+	}
 
-		if r.Action == action_delete {
-			k := r.Node.Key
-			InfoLogger.Printf("Actor %v removed from the registry", k)
+	_, err = etcdClient.client.Put(ctx, etcdMigrationKey, time.Now().UTC().Format(time.RFC3339))
 
-			cbDelete(k)
-		} else if r.Action == action_set {
-			k, v := parseNode(r.Node)
+	return err
+}
 
-			InfoLogger.Printf("New actor %v added to the registry", k)
+func (etcdClient *etcdClient) grant() error {
+	ctx, cancel := context.WithTimeout(etcdClient.ctx, etcdRequestTimeout)
+	defer cancel()
 
-			cbCreate(k, v)
+	resp, err := etcdClient.client.Grant(ctx, etcdClient.ttl)
+	if err != nil {
+		return err
+	}
+
+	etcdClient.mutex.Lock()
+	etcdClient.lease = resp.ID
+	etcdClient.mutex.Unlock()
+
+	InfoLogger.Printf("etcd lease %x granted for %vs", resp.ID, etcdClient.ttl)
+
+	return nil
+}
+
+//If the lease is lost (e.g. expired during a network partition), a new one is granted and the actors are registered again
+func (etcdClient *etcdClient) keepAlive() {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	for {
+		etcdClient.mutex.Lock()
+		lease := etcdClient.lease
+		etcdClient.mutex.Unlock()
+
+		ch, err := etcdClient.client.KeepAlive(etcdClient.ctx, lease)
+		if err == nil {
+			for range ch {
+				b.reset()
+			}
+		}
+
+		if etcdClient.ctx.Err() != nil {
+			return
 		}
+
+		d := b.next()
+		ErrorLogger.Printf("etcd lease %x lost, granting a new one in %v", lease, d)
+		select {
+		case <-time.After(d):
+		case <-etcdClient.ctx.Done():
+			return
+		}
+
+		err = etcdClient.grant()
+		if err != nil {
+			ErrorLogger.Printf("etcd lease error %v", err)
+			continue
+		}
+		etcdClient.restore()
 	}
 }
 
-func parseNode(node *client.Node) (string, *ActorOptions) {
-	v := node.Value
-	a :=
-		strings.Split(v, delimiter)
-	k := node.Key
+func (etcdClient *etcdClient) restore() {
+	etcdClient.mutex.Lock()
+	actors := make(map[string]string, len(etcdClient.actors))
+	for k, v := range etcdClient.actors {
+		actors[k] = v
+	}
+	etcdClient.mutex.Unlock()
 
-	return k[len(actors_configuration):], &ActorOptions{a[0], true, true, a[1], a[2], a[3], 0, 0}
+	for k, v := range actors {
+		err := etcdClient.put(k, v)
+		if err != nil {
+			ErrorLogger.Printf("Failed to register actor %v again: %v", k, err)
+		}
+	}
 }
 
-func (etcdClient *etcdClient) ParseConfiguration() (map[string]OptionsInterface, error) {
-	resp, err := etcdClient.Get(actors_configuration)
+//The lease is revoked so that the actors of the system are removed straight away
+func (etcdClient *etcdClient) Close() {
+	if etcdClient.ctx.Err() != nil {
+		return
+	}
+	etcdClient.cancel()
+
+	if etcdClient.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
 
+	etcdClient.mutex.Lock()
+	lease := etcdClient.lease
+	etcdClient.mutex.Unlock()
+
+	_, err := etcdClient.client.Revoke(ctx, lease)
 	if err != nil {
-		return nil, nil
+		ErrorLogger.Printf("etcd revoke error %v", err)
+	}
+	etcdClient.client.Close()
+}
+
+//The watch starts from the revision of the last listing and resumes from the last revision received after an error.
+//If this revision has been compacted meanwhile, the registry is listed again and compared with the known entries.
+func (etcdClient *etcdClient) Watch(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	//The listing of the configuration parsed before, if any, is the starting point of the watch
+	etcdClient.mutex.Lock()
+	etcdClient.watching = true
+	listed := etcdClient.entries != nil
+	etcdClient.mutex.Unlock()
+
+	if !listed {
+		entries, revision, err := etcdClient.list()
+		if err != nil {
+			return err
+		}
+		etcdClient.entries = entries
+		etcdClient.revision = revision
+	}
+
+	for {
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(etcdClient.ctx))
+		ch := etcdClient.client.Watch(ctx, etcdClient.prefix(), clientv3.WithPrefix(), clientv3.WithRev(etcdClient.revision+1))
+
+		var err error
+		compacted := false
+		for resp := range ch {
+			if resp.CompactRevision != 0 {
+				compacted = true
+				err = etcdClient.resync(cbCreate, cbDelete)
+				break
+			}
+			if err = resp.Err(); err != nil {
+				break
+			}
+			b.reset()
+
+			for _, e := range resp.Events {
+				etcdClient.notify(e, cbCreate, cbDelete)
+			}
+			etcdClient.revision = resp.Header.Revision
+		}
+		cancel()
+
+		if etcdClient.ctx.Err() != nil {
+			return nil
+		}
+		if compacted && err == nil {
+			continue
+		}
+
+		d := b.next()
+		ErrorLogger.Printf("etcd watch interrupted at revision %v, resuming in %v: %v", etcdClient.revision, d, err)
+		select {
+		case <-time.After(d):
+		case <-etcdClient.ctx.Done():
+			return nil
+		}
 	}
+}
 
-	conf := make(map[string]OptionsInterface)
+func (etcdClient *etcdClient) notify(e *clientv3.Event, cbCreate func(string, *ActorOptions), cbDelete func(string)) {
+	k, discovered := etcdClient.actorName(strings.TrimPrefix(string(e.Kv.Key), actors_configuration))
+	if !discovered {
+		return
+	}
 
-	nodes := resp.Node.Nodes
-	for i := 0; i < nodes.Len(); i++ {
-		k, v := parseNode(nodes[i])
-		conf[k] = v
+	if e.Type == clientv3.EventTypeDelete {
+		delete(etcdClient.entries, k)
+		InfoLogger.Printf("Actor %v removed from the registry", k)
+
+		cbDelete(k)
+		return
+	}
+
+	v := string(e.Kv.Value)
+	if etcdClient.entries[k] == v {
+		return
 	}
+	etcdClient.entries[k] = v
 
-	return conf, nil
+	options, err := decodeRegistryEntry(k, v)
+	if err != nil {
+		ErrorLogger.Printf("%v", err)
+		return
+	}
+
+	InfoLogger.Printf("New actor %v added to the registry", k)
+
+	cbCreate(k, options)
 }
 
-func (etcdClient *etcdClient) RegisterActor(name string, options OptionsInterface) error {
-	k := actors_configuration + name
-	v := options.Parent() + delimiter + options.RemoteType() + delimiter + options.Url() + delimiter + options.Destination()
+func (etcdClient *etcdClient) resync(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
+	InfoLogger.Printf("etcd revision %v compacted, listing the registry again", etcdClient.revision)
 
-	err := etcdClient.Set(k, v)
+	previous := etcdClient.entries
+	current, revision, err := etcdClient.list()
 	if err != nil {
-		ErrorLogger.Printf("Failed to register actor %v: %v", k, err)
 		return err
 	}
+	etcdClient.entries = current
+	etcdClient.revision = revision
+	notifyRegistryChanges(previous, current, cbCreate, cbDelete)
 
 	return nil
 }
 
-func (etcdClient *etcdClient) UnregisterActor(name string) error {
-	return etcdClient.Delete(actors_configuration + name)
+//Lists the actors with the revision of the listing
+func (etcdClient *etcdClient) list() (map[string]string, int64, error) {
+	ctx, cancel := context.WithTimeout(etcdClient.ctx, etcdRequestTimeout)
+	defer cancel()
+
+	resp, err := etcdClient.client.Get(ctx, etcdClient.prefix(), clientv3.WithPrefix())
+	if err != nil {
+		ErrorLogger.Printf("etcd get %v error %v", etcdClient.prefix(), err)
+		return nil, 0, err
+	}
+
+	entries := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		k, discovered := etcdClient.actorName(strings.TrimPrefix(string(kv.Key), actors_configuration))
+		if discovered {
+			entries[k] = string(kv.Value)
+		}
+	}
+
+	return entries, resp.Header.Revision, nil
+}
+
+func etcdEndpoints(urls []string) ([]string, int64, error) {
+	var endpoints []string
+	var ttl int64
+	for _, u := range urls {
+		if i := strings.Index(u, "?"); i != -1 {
+			query, err := url.ParseQuery(u[i+1:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid etcd url %v: %v", u, err)
+			}
+			if v := query.Get("ttl"); v != "" {
+				ttl, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || ttl <= 0 {
+					return nil, 0, fmt.Errorf("invalid etcd lease ttl %v", v)
+				}
+			}
+			u = u[:i]
+		}
+
+		if !strings.HasPrefix(u, "etcd://") {
+			endpoints = append(endpoints, u)
+			continue
+		}
+
+		for _, host := range strings.Split(strings.TrimPrefix(u, "etcd://"), ",") {
+			endpoints = append(endpoints, "http://"+strings.TrimSuffix(host, "/"))
+		}
+	}
+
+	return endpoints, ttl, nil
 }
 
-func (etcdClient *etcdClient) createDir(key string) {
-	opt := new(client.SetOptions)
-	opt.Dir = true
+//Returns a snapshot of the registry, kept as the starting point of the watch if not started yet
+func (etcdClient *etcdClient) ParseConfiguration() (map[string]OptionsInterface, error) {
+	entries, revision, err := etcdClient.list()
+	if err != nil {
+		return nil, err
+	}
+
+	etcdClient.mutex.Lock()
+	if !etcdClient.watching {
+		etcdClient.entries = make(map[string]string, len(entries))
+		for k, v := range entries {
+			etcdClient.entries[k] = v
+		}
+		etcdClient.revision = revision
+	}
+	etcdClient.mutex.Unlock()
 
-	etcdClient.api.Set(context.Background(), key, "", opt)
+	return decodeRegistryEntries(entries), nil
 }
 
-func (etcdClient *etcdClient) Set(key string, value string) error {
-	_, err := etcdClient.api.Set(context.Background(), key, value, nil)
+func (etcdClient *etcdClient) RegisterActor(name string, options OptionsInterface) error {
+	k := etcdClient.key(name)
+	v := encodeRegistryEntry(options)
 
+	etcdClient.mutex.Lock()
+	etcdClient.actors[k] = v
+	etcdClient.mutex.Unlock()
+
+	err := etcdClient.put(k, v)
 	if err != nil {
-		ErrorLogger.Printf("etcd set %v error %v", key, err)
+		ErrorLogger.Printf("Failed to register actor %v: %v", k, err)
+		return err
 	}
 
+	return nil
+}
+
+func (etcdClient *etcdClient) put(key string, value string) error {
+	ctx, cancel := context.WithTimeout(etcdClient.ctx, etcdRequestTimeout)
+	defer cancel()
+
+	etcdClient.mutex.Lock()
+	lease := etcdClient.lease
+	etcdClient.mutex.Unlock()
+
+	_, err := etcdClient.client.Put(ctx, key, value, clientv3.WithLease(lease))
+
 	return err
 }
 
-func (etcdClient *etcdClient) Delete(key string) error {
-	_, err := etcdClient.api.Delete(context.Background(), key, nil)
+func (etcdClient *etcdClient) UnregisterActor(name string) error {
+	k := etcdClient.key(name)
+
+	etcdClient.mutex.Lock()
+	delete(etcdClient.actors, k)
+	etcdClient.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(etcdClient.ctx, etcdRequestTimeout)
+	defer cancel()
+
+	_, err := etcdClient.client.Delete(ctx, k)
 
 	return err
 }
 
-func (etcdClient *etcdClient) Get(key string) (*client.Response, error) {
-	resp, err := etcdClient.api.Get(context.Background(), key, &client.GetOptions{
-		Recursive: false,
-		Sort:      false,
-		Quorum:    false,
-	})
+//Leader of an election last sent to the channel, by the observer or by the campaign losing its session
+type etcdLeader struct {
+	leaders chan<- string
+	leader  string
+	sent    bool
+	mutex   sync.Mutex
+}
 
-	if err != nil {
-		ErrorLogger.Printf("etcd get %v error %v", key, err)
-		return resp, err
+//Sends the leader if it changed, unless the election is stopped
+func (l *etcdLeader) send(ctx context.Context, leader string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.sent && l.leader == leader {
+		return
+	}
+
+	select {
+	case l.leaders <- leader:
+		l.leader, l.sent = leader, true
+	case <-ctx.Done():
+	}
+}
+
+//A candidate losing its session is no longer the leader, even if its key is not deleted yet
+//(e.g. etcd being unreachable), its singleton being stopped right away
+func (l *etcdLeader) lost(ctx context.Context, candidate string) {
+	l.mutex.Lock()
+	leader := l.leader
+	l.mutex.Unlock()
+
+	if leader == candidate {
+		l.send(ctx, "")
 	}
+}
+
+//Each campaign runs in a session of its own, whose lease is revoked when resigning. If the session is lost
+//(e.g. during a network partition), the candidate stops leading and campaigns again.
+func (etcdClient *etcdClient) elect(election string, candidate string, leaders chan<- string) (func(), error) {
+	ctx, cancel := context.WithCancel(etcdClient.ctx)
+	prefix := electionsConfiguration + etcdClient.relativeKey(election)
+	leader := &etcdLeader{leaders: leaders}
+	done := make(chan struct{})
+
+	if candidate != "" {
+		go func() {
+			defer close(done)
+			etcdClient.campaign(ctx, prefix, candidate, leader)
+		}()
+	} else {
+		close(done)
+	}
+	go etcdClient.observe(ctx, prefix, leader)
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+func (etcdClient *etcdClient) campaign(ctx context.Context, prefix string, candidate string, leader *etcdLeader) {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	for {
+		session, err := concurrency.NewSession(etcdClient.client, concurrency.WithTTL(int(etcdClient.ttl)))
+		if err == nil {
+			err = concurrency.NewElection(session, prefix).Campaign(ctx, candidate)
+			if err == nil {
+				b.reset()
+				select {
+				case <-session.Done():
+					err = fmt.Errorf("session lost")
+				case <-ctx.Done():
+				}
+			}
+			//Revokes the lease of the session, deleting the key of the candidate
+			session.Close()
+		}
 
-	return resp, err
+		if ctx.Err() != nil {
+			return
+		}
+		leader.lost(ctx, candidate)
+
+		d := b.next()
+		ErrorLogger.Printf("etcd election %v error, campaigning again in %v: %v", prefix, d, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (etcdClient *etcdClient) GetValue(key string) (string, error) {
-	resp, err := etcdClient.Get(key)
+//The leader is the candidate whose key was created first, listed again after each change of the election
+func (etcdClient *etcdClient) observe(ctx context.Context, prefix string, leader *etcdLeader) {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	for {
+		resp, err := etcdClient.client.Get(ctx, prefix+"/", clientv3.WithFirstCreate()...)
+		if err == nil {
+			current := ""
+			if len(resp.Kvs) != 0 {
+				current = string(resp.Kvs[0].Value)
+			}
+			leader.send(ctx, current)
+
+			watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+			change, ok := <-etcdClient.client.Watch(watchCtx, prefix+"/", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+			cancel()
+			if ok {
+				err = change.Err()
+			}
+			if ok && err == nil {
+				b.reset()
+				continue
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
 
-	return resp.Node.Value, err
+		d := b.next()
+		ErrorLogger.Printf("etcd election %v observation error, retrying in %v: %v", prefix, d, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,256 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gatewayActorsPath     = "/actors/"
+	gatewayWebSocketPath  = "/ws/"
+	gatewayReplyParameter = "reply"
+	gatewayTimeout        = "timeout"
+	gatewayAskPrefix      = "gosirisAsk"
+	gatewaySender         = "gosirisGateway"
+	defaultAskTimeout     = 5 * time.Second
+)
+
+var gatewayAskCounter uint64
+
+type Gateway struct {
+	askTimeout time.Duration
+	sender     ActorRefInterface
+	upgrader   websocket.Upgrader
+}
+
+type gatewayMessage struct {
+	MessageType string      `json:"messageType"`
+	Data        interface{} `json:"data"`
+	Self        string      `json:"self,omitempty"`
+	Sender      string      `json:"sender,omitempty"`
+}
+
+//Gateway exposes the actor system over HTTP:
+//POST /actors/{name}/{messageType} tells the body to an actor (?reply=true&timeout=2s to wait for its reply, the actor
+//being hosted by this actor system)
+//GET /ws/{name} registers a WebSocket client as an actor named {name}
+func NewGateway(askTimeout time.Duration) *Gateway {
+	if askTimeout == 0 {
+		askTimeout = defaultAskTimeout
+	}
+
+	return &Gateway{
+		askTimeout: askTimeout,
+		sender:     newActorRef(gatewaySender),
+	}
+}
+
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, gatewayActorsPath) {
+		gateway.serveActor(w, r)
+	} else if strings.HasPrefix(r.URL.Path, gatewayWebSocketPath) {
+		gateway.serveWebSocket(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func (gateway *Gateway) serveActor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a := strings.Split(strings.TrimPrefix(r.URL.Path, gatewayActorsPath), "/")
+	if len(a) != 2 || a[0] == "" || a[1] == "" {
+		http.Error(w, "expected /actors/{name}/{messageType}", http.StatusNotFound)
+		return
+	}
+	name, messageType := a[0], a[1]
+
+	actorRef, err := ActorSystem().ActorOf(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := gatewayData(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get(gatewayReplyParameter) != "true" {
+		err = actorRef.Tell(EmptyContext, messageType, data, gateway.sender)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	//The reply is sent to a mailbox of this actor system, not reachable by the actors hosted by the other ones
+	if a, _ := ActorSystem().actor(name); a.options != nil && a.options.Remote() && !a.hosted() {
+		http.Error(w, fmt.Sprintf("actor %v is hosted by another actor system, no reply can be waited for", name), http.StatusBadRequest)
+		return
+	}
+
+	timeout := gateway.askTimeout
+	if t := r.URL.Query().Get(gatewayTimeout); t != "" {
+		timeout, err = time.ParseDuration(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	reply, err := ask(actorRef, messageType, data, timeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newGatewayMessage(reply))
+}
+
+func (gateway *Gateway) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, gatewayWebSocketPath)
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "expected /ws/{name}", http.StatusNotFound)
+		return
+	}
+
+	actorRef, mailbox, err := spawnMailbox(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	conn, err := gateway.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		ErrorLogger.Printf("WebSocket upgrade error for %v: %v", name, err)
+		ActorSystem().deleteActor(name)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+
+	InfoLogger.Printf("WebSocket client registered as actor %v", name)
+
+	go func() {
+		for {
+			select {
+			case message := <-mailbox:
+				err := conn.WriteJSON(newGatewayMessage(message))
+				if err != nil {
+					ErrorLogger.Printf("WebSocket write error for %v: %v", name, err)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		message := gatewayMessage{}
+		err := conn.ReadJSON(&message)
+		if err != nil {
+			InfoLogger.Printf("WebSocket client %v disconnected: %v", name, err)
+			break
+		}
+
+		target, err := ActorSystem().ActorOf(message.Self)
+		if err != nil {
+			ErrorLogger.Printf("WebSocket client %v: %v", name, err)
+			continue
+		}
+
+		target.Tell(EmptyContext, message.MessageType, message.Data, actorRef)
+	}
+
+	//The mailbox is left open, a message possibly being dispatched to the actor while it is unregistered
+	ActorSystem().deleteActor(name)
+	close(done)
+}
+
+//The replies are sent back with the same JSON shape over HTTP and WebSocket, the data being left raw
+func newGatewayMessage(context Context) gatewayMessage {
+	message := gatewayMessage{
+		MessageType: context.MessageType,
+		Data:        context.Data,
+	}
+	if context.Sender != nil {
+		message.Sender = context.Sender.Name()
+	}
+
+	return message
+}
+
+//Ask tells a message to an actor and waits for the first message sent back to the temporary sender
+func ask(actorRef ActorRefInterface, messageType string, data interface{}, timeout time.Duration) (Context, error) {
+	name := fmt.Sprintf("%v%v", gatewayAskPrefix, atomic.AddUint64(&gatewayAskCounter, 1))
+	sender, mailbox, err := spawnMailbox(name)
+	if err != nil {
+		return EmptyContext, err
+	}
+	defer ActorSystem().deleteActor(name)
+
+	err = actorRef.Tell(EmptyContext, messageType, data, sender)
+	if err != nil {
+		return EmptyContext, err
+	}
+
+	select {
+	case reply := <-mailbox:
+		return reply, nil
+	case <-time.After(timeout):
+		return EmptyContext, fmt.Errorf("no reply from %v after %v", actorRef.Name(), timeout)
+	}
+}
+
+//A mailbox actor has no reactions, its messages are consumed directly from its data channel
+func spawnMailbox(name string) (ActorRefInterface, chan Context, error) {
+	mailbox := make(chan Context, defaultBufferSize)
+
+	actor := new(Actor)
+	actor.setName(name)
+	actor.setParent(RootActor())
+	actor.setDataChan(mailbox)
+
+	actorRef := newActorRef(name)
+	if !ActorSystem().setActorIfAbsent(name, actorAssociation{actorRef, actor, &ActorOptions{}}) {
+		return nil, nil, fmt.Errorf("actor %v already registered", name)
+	}
+
+	return actorRef, mailbox, nil
+}
+
+func gatewayData(r *http.Request) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return string(body), nil
+	}
+
+	var data interface{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package gosiris
+
+import (
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	t.Log("Starting gateway test")
+
+	opts := SystemOptions{
+		ActorSystemName: "ActorSystem",
+	}
+	InitActorSystem(opts)
+	defer CloseActorSystem()
+
+	received := make(chan interface{}, 1)
+	actor := new(Actor).React("hello", func(context Context) {
+		context.Self.LogInfo(context, "Received %v", context.Data)
+		received <- context.Data
+	}).React("ping", func(context Context) {
+		context.Sender.Tell(context, "pong", context.Data, context.Self)
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("actor", actor, nil)
+
+	server := httptest.NewServer(NewGateway(time.Second))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/actors/actor/hello", "text/plain", strings.NewReader("world"))
+	if err != nil {
+		t.Fatalf("Tell error: %v", err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Unexpected status %v", resp.StatusCode)
+	}
+	select {
+	case d := <-received:
+		if d != "world" {
+			t.Errorf("Unexpected data %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Message not received")
+	}
+
+	resp, err = http.Post(server.URL+"/actors/actor/ping?reply=true", "application/json", strings.NewReader(`"x"`))
+	if err != nil {
+		t.Fatalf("Ask error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"messageType":"pong"`) {
+		t.Errorf("Unexpected reply %v: %s", resp.StatusCode, body)
+	}
+
+	resp, _ = http.Post(server.URL+"/actors/actor/hello?reply=true&timeout=50ms", "text/plain", nil)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Unexpected status %v", resp.StatusCode)
+	}
+	<-received
+
+	//No reply can be waited for from an actor hosted by another actor system
+	ActorSystem().RegisterRemoteActor("remoteActor", new(ActorOptions).SetRemote(true).SetRemoteType(Memory).SetUrl("gateway").SetDestination("remoteActor"))
+	resp, _ = http.Post(server.URL+"/actors/remoteActor/ping?reply=true", "text/plain", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status %v", resp.StatusCode)
+	}
+
+	resp, _ = http.Post(server.URL+"/actors/unknown/hello", "text/plain", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected status %v", resp.StatusCode)
+	}
+
+	//A browser client acting as the actor "browser"
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/browser", nil)
+	if err != nil {
+		t.Fatalf("WebSocket error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(gatewayMessage{MessageType: "ping", Data: map[string]interface{}{"text": "from browser"}, Self: "actor"})
+	reply := gatewayMessage{}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	err = conn.ReadJSON(&reply)
+	if err != nil {
+		t.Fatalf("WebSocket read error: %v", err)
+	}
+	//The data are sent back as JSON, as with the HTTP replies
+	data, ok := reply.Data.(map[string]interface{})
+	if reply.MessageType != "pong" || !ok || data["text"] != "from browser" || reply.Sender != "actor" {
+		t.Errorf("Unexpected reply %v", reply)
+	}
+
+	//Concurrent clients under the same name, a single one being registered
+	conns := make(chan *websocket.Conn, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/concurrent", nil)
+			if err == nil {
+				conns <- c
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+
+	registered := 0
+	for c := range conns {
+		registered++
+		c.Close()
+	}
+	if registered != 1 {
+		t.Errorf("WebSocket clients registered %v times under the same name", registered)
+	}
+}
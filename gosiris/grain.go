@@ -0,0 +1,263 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Persists the state of the grains, reloaded when they are activated
+type GrainStorage interface {
+	Load(kind string, id string) ([]byte, error) //Nil if the grain has no state
+	Save(kind string, id string, state []byte) error
+	Delete(kind string, id string) error
+}
+
+type GrainOptions struct {
+	Storage     GrainStorage     //Storage of the state of the grains (default: none, the state being lost once deactivated)
+	IdleTimeout time.Duration    //Idle time after which a grain is deactivated (default: 2m, negative to keep the grains)
+	Remote      OptionsInterface //Transport the grains of this node are reached through by the other members, required in a cluster
+}
+
+//State of a grain, loaded from the storage when the grain is activated and saved each time it is written
+type GrainState struct {
+	kind    string
+	id      string
+	data    []byte
+	storage GrainStorage
+	mutex   sync.Mutex
+}
+
+//Reference to a grain, activated by the first message told
+type grainRef struct {
+	ActorRef
+	kind string
+	id   string
+}
+
+//Registers a kind of virtual actors (grains) created by a factory. A grain always exists: it is activated on its first
+//message, on the node its shard is allocated to, then deactivated once idle and activated again by the next message,
+//its state being reloaded from the storage. The grains are the entities of the shard region of their kind.
+func RegisterGrain(kind string, factory func(string, *GrainState) *Actor, options GrainOptions) error {
+	shardRegionsMutex.Lock()
+	defer shardRegionsMutex.Unlock()
+
+	if _, exists := shardRegions[kind]; exists {
+		return fmt.Errorf("grain %v already registered", kind)
+	}
+
+	election, _ := registry.(registryElection)
+	region, err := newShardRegion(kind, grainSharding(kind, factory, options), clusterInstance, election, nodeId)
+	if err != nil {
+		return err
+	}
+	shardRegions[kind] = region
+
+	return nil
+}
+
+func grainSharding(kind string, factory func(string, *GrainState) *Actor, options GrainOptions) ShardingOptions {
+	return ShardingOptions{
+		Entity: func(id string) *Actor {
+			state, err := loadGrainState(kind, id, options.Storage)
+			if err != nil {
+				ErrorLogger.Printf("Failed to load the state of grain %v/%v: %v", kind, id, err)
+				return nil
+			}
+			return factory(id, state)
+		},
+		PassivationTimeout: options.IdleTimeout,
+		Remote:             options.Remote,
+	}
+}
+
+//Returns the reference to the grain of a kind and an identifier, whether it is active or not (or to an entity of a shard region).
+//The kind may be registered by other members of the cluster only.
+func (system *actorSystem) VirtualActorOf(kind string, id string) ActorRefInterface {
+	return &grainRef{
+		ActorRef: newActorRef(kind + "/" + id).(ActorRef),
+		kind:     kind,
+		id:       id,
+	}
+}
+
+//A grain of a kind only registered by other members of the cluster is told through one of their regions
+func (ref *grainRef) Tell(context Context, messageType string, data interface{}, sender ActorRefInterface) error {
+	shardRegionsMutex.Lock()
+	region, exists := shardRegions[ref.kind]
+	shardRegionsMutex.Unlock()
+
+	context.MessageType = messageType
+	context.Data = data
+	context.Sender = sender
+	context.Self = ref
+
+	if exists {
+		return region.routeEntity(ref.id, context)
+	}
+
+	name := remoteGrainRegion(ref.kind, ref.id)
+	if name == "" {
+		ErrorLogger.Printf("Grain %v not registered", ref.kind)
+		return fmt.Errorf("grain %v not registered", ref.kind)
+	}
+
+	return forwardShardEnvelope(name, ref.id, "", context, ref)
+}
+
+//Returns the region of a kind of grains discovered on the members up, spread over the grains by rendezvous hashing
+func remoteGrainRegion(kind string, id string) string {
+	if clusterInstance == nil {
+		return ""
+	}
+
+	regions := make(map[string]string)
+	var nodes []string
+	for _, m := range clusterInstance.Members() {
+		name := m.Metadata[shardRegionMetadata+kind]
+		if name == "" || m.Status != MemberStatusUp {
+			continue
+		}
+		if _, err := ActorSystem().ActorOf(name); err != nil {
+			continue
+		}
+
+		regions[m.Id] = name
+		nodes = append(nodes, m.Id)
+	}
+
+	return regions[allocateShard(id, nodes)]
+}
+
+func (ref *grainRef) Repeat(messageType string, d time.Duration, data interface{}, sender ActorRefInterface) (chan struct{}, error) {
+	t := time.NewTicker(d)
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				ref.Tell(EmptyContext, messageType, data, sender)
+			case <-stop:
+				t.Stop()
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+func loadGrainState(kind string, id string, storage GrainStorage) (*GrainState, error) {
+	state := &GrainState{
+		kind:    kind,
+		id:      id,
+		storage: storage,
+	}
+
+	if storage != nil {
+		data, err := storage.Load(kind, id)
+		if err != nil {
+			return nil, err
+		}
+		state.data = data
+	}
+
+	return state, nil
+}
+
+//Whether the grain has a state
+func (state *GrainState) Exists() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	return state.data != nil
+}
+
+//Decodes the state of the grain, left untouched if the grain has no state
+func (state *GrainState) Read(v interface{}) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.data == nil {
+		return nil
+	}
+
+	return json.Unmarshal(state.data, v)
+}
+
+//Encodes the state of the grain as JSON and saves it
+func (state *GrainState) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.storage != nil {
+		err = state.storage.Save(state.kind, state.id, data)
+		if err != nil {
+			ErrorLogger.Printf("Failed to save the state of grain %v/%v: %v", state.kind, state.id, err)
+			return err
+		}
+	}
+	state.data = data
+
+	return nil
+}
+
+func (state *GrainState) Clear() error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.storage != nil {
+		err := state.storage.Delete(state.kind, state.id)
+		if err != nil {
+			return err
+		}
+	}
+	state.data = nil
+
+	return nil
+}
+
+type memoryGrainStorage struct {
+	states map[string][]byte
+	mutex  sync.Mutex
+}
+
+//Storage keeping the state of the grains in memory, e.g. for tests
+func NewMemoryGrainStorage() GrainStorage {
+	return &memoryGrainStorage{
+		states: make(map[string][]byte),
+	}
+}
+
+func (storage *memoryGrainStorage) Load(kind string, id string) ([]byte, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.states[kind+"/"+id], nil
+}
+
+func (storage *memoryGrainStorage) Save(kind string, id string, state []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.states[kind+"/"+id] = state
+
+	return nil
+}
+
+func (storage *memoryGrainStorage) Delete(kind string, id string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	delete(storage.states, kind+"/"+id)
+
+	return nil
+}
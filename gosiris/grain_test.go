@@ -0,0 +1,155 @@
+package gosiris
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVirtualActor(t *testing.T) {
+	t.Log("Starting virtual actor test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "ActorSystem",
+	})
+	defer CloseActorSystem()
+
+	var activations int32
+	counts := make(chan int, 10)
+	err := RegisterGrain("counter", func(id string, state *GrainState) *Actor {
+		atomic.AddInt32(&activations, 1)
+		count := 0
+		state.Read(&count)
+
+		return new(Actor).React("increment", func(context Context) {
+			count++
+			state.Write(count)
+			context.Sender.Tell(context, "count", count, context.Self)
+		})
+	}, GrainOptions{
+		Storage:     NewMemoryGrainStorage(),
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := new(Actor).React("count", func(context Context) {
+		counts <- context.Data.(int)
+	})
+	defer client.Close()
+	ActorSystem().RegisterActor("grainClient", client, nil)
+	clientRef, _ := ActorSystem().ActorOf("grainClient")
+
+	expectCount := func(expected int) {
+		select {
+		case count := <-counts:
+			if count != expected {
+				t.Errorf("Unexpected count %v instead of %v", count, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Count %v not received", expected)
+		}
+	}
+
+	//The grain is activated by its first message, without being spawned
+	counter := ActorSystem().VirtualActorOf("counter", "c1")
+	counter.Tell(EmptyContext, "increment", nil, clientRef)
+	expectCount(1)
+	ActorSystem().VirtualActorOf("counter", "c1").Tell(EmptyContext, "increment", nil, clientRef)
+	expectCount(2)
+	ActorSystem().VirtualActorOf("counter", "c2").Tell(EmptyContext, "increment", nil, clientRef)
+	expectCount(1)
+	if n := atomic.LoadInt32(&activations); n != 2 {
+		t.Errorf("Unexpected number of activations %v", n)
+	}
+
+	//Once deactivated, the grain is activated again with its state reloaded
+	time.Sleep(time.Second)
+	if _, err := ActorSystem().ActorOf("counter/c1"); err == nil {
+		t.Errorf("Idle grain not deactivated")
+	}
+	counter.Tell(EmptyContext, "increment", nil, clientRef)
+	expectCount(3)
+	if n := atomic.LoadInt32(&activations); n != 3 {
+		t.Errorf("Unexpected number of activations %v", n)
+	}
+
+	if err := ActorSystem().VirtualActorOf("unknown", "u1").Tell(EmptyContext, "increment", nil, clientRef); err == nil {
+		t.Errorf("Grain of an unregistered kind told")
+	}
+}
+
+func TestVirtualActorCluster(t *testing.T) {
+	t.Log("Starting virtual actor cluster test")
+
+	err := InitActorSystem(SystemOptions{
+		ActorSystemName: "GrainSystem",
+		RegistryUrl:     "mem://TestVirtualActorCluster",
+		NodeId:          "grainNodeA",
+		ClusterOptions:  clusterTestOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseActorSystem()
+
+	//Node B registers the grains, node A only tells them
+	nodeB := newClusterTestNode(t, "grainNodeB", Cluster().Self().Address)
+	defer nodeB.stop()
+	registryB, _ := newRegistry("mem://TestVirtualActorCluster", registryNamespace{namespace: "GrainSystem"})
+	defer registryB.Close()
+	regionB, err := newShardRegion("remoteCounter", grainSharding("remoteCounter", func(id string, state *GrainState) *Actor {
+		count := 0
+		return new(Actor).React("increment", func(context Context) {
+			count++
+			context.Sender.Tell(context, "count", count, context.Self)
+		})
+	}, GrainOptions{
+		Remote: new(ActorOptions).SetRemoteType(Memory).SetUrl("TestVirtualActorCluster"),
+	}), nodeB, registryB.(registryElection), "grainNodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regionB.close()
+
+	counts := make(chan int, 10)
+	client := new(Actor).React("count", func(context Context) {
+		counts <- context.Data.(int)
+	})
+	defer client.Close()
+	ActorSystem().RegisterActor("remoteGrainClient", client, nil)
+	clientRef, _ := ActorSystem().ActorOf("remoteGrainClient")
+
+	//Told once the region of node B is discovered
+	counter := ActorSystem().VirtualActorOf("remoteCounter", "c1")
+	for i := 0; ; i++ {
+		err = counter.Tell(EmptyContext, "increment", nil, clientRef)
+		if err == nil {
+			break
+		}
+		if i == 200 {
+			t.Fatalf("Grain not told: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expectCount := func(expected int) {
+		select {
+		case count := <-counts:
+			if count != expected {
+				t.Errorf("Unexpected count %v instead of %v", count, expected)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Count %v not received", expected)
+		}
+	}
+
+	//The grain is activated once, on node B
+	expectCount(1)
+	counter.Tell(EmptyContext, "increment", nil, clientRef)
+	expectCount(2)
+	if _, err := ActorSystem().actor("remoteCounter/c1"); err != nil {
+		t.Errorf("Grain not activated by node B: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	pubsubMediatorMetadata = "gosiris.pubsub.mediator" //Member metadata naming the mediator actor of the node
+	pubsubTopicsMetadata   = "gosiris.pubsub.topics"   //Member metadata listing the groups subscribed per topic, "" for the plain subscribers
+)
+
+var mediatorInstance *mediator
+var mediatorMutex sync.Mutex
+
+type MediatorOptions struct {
+	Remote OptionsInterface //Transport the mediator of this node is reached through by the other members, its destination being set by gosiris
+}
+
+//Message published to the mediator of another node, the data being JSON encoded
+type pubsubEnvelope struct {
+	Topic       string          `json:"topic"`
+	Group       string          `json:"group,omitempty"`
+	MessageType string          `json:"messageType"`
+	Data        json.RawMessage `json:"data"`
+}
+
+//The mediator of a node keeps the subscriptions of its actors, published to the other members in the metadata of the node.
+//A message published to a topic is told to every plain subscriber of the topic across the cluster, each node receiving
+//it once through its mediator, and to one subscriber of each group of the topic, on a node picked at random among the
+//nodes subscribed to the group. The subscriptions of the other nodes are known once gossiped.
+type mediator struct {
+	cluster *cluster
+	node    string
+	ref     ActorRefInterface
+	actor   *Actor
+	topics  map[string]map[string]map[string]ActorRefInterface //Topic, group, subscriber name
+	mutex   sync.Mutex
+}
+
+//Starts the mediator of this node, local if the actor system is not clustered
+func StartMediator(options MediatorOptions) error {
+	mediatorMutex.Lock()
+	defer mediatorMutex.Unlock()
+
+	if mediatorInstance != nil {
+		return fmt.Errorf("mediator already started")
+	}
+
+	m, err := newMediator(options, clusterInstance, nodeId)
+	if err != nil {
+		return err
+	}
+	mediatorInstance = m
+
+	return nil
+}
+
+//Returns the mediator of this node, nil if not started
+func Mediator() *mediator {
+	mediatorMutex.Lock()
+	defer mediatorMutex.Unlock()
+
+	return mediatorInstance
+}
+
+func closeMediator() {
+	mediatorMutex.Lock()
+	defer mediatorMutex.Unlock()
+
+	if mediatorInstance != nil {
+		mediatorInstance.close()
+		mediatorInstance = nil
+	}
+}
+
+func newMediator(options MediatorOptions, c *cluster, node string) (*mediator, error) {
+	name := pubsubMediatorName(node)
+	m := &mediator{
+		cluster: c,
+		node:    node,
+		ref:     newActorRef(name),
+		topics:  make(map[string]map[string]map[string]ActorRefInterface),
+	}
+
+	if c != nil && options.Remote != nil {
+		m.actor = new(Actor).React(GosirisMsgPublish, m.receiveEnvelope)
+		err := ActorSystem().RegisterActor(name, m.actor, options.Remote.SetRemote(true).SetDestination(name))
+		if err != nil {
+			return nil, err
+		}
+		m.ref, _ = ActorSystem().ActorOf(name)
+		c.SetMetadata(pubsubMediatorMetadata, name)
+	}
+
+	return m, nil
+}
+
+func pubsubMediatorName(node string) string {
+	return "mediator@" + node
+}
+
+//Subscribes an actor to a topic, receiving all the messages published
+func (m *mediator) Subscribe(topic string, actorRef ActorRefInterface) error {
+	return m.SubscribeGroup(topic, "", actorRef)
+}
+
+//Subscribes an actor to a topic within a group, each message published being received by one subscriber of the group
+func (m *mediator) SubscribeGroup(topic string, group string, actorRef ActorRefInterface) error {
+	if topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	groups, exists := m.topics[topic]
+	if !exists {
+		groups = make(map[string]map[string]ActorRefInterface)
+		m.topics[topic] = groups
+	}
+	subscribers, exists := groups[group]
+	if !exists {
+		subscribers = make(map[string]ActorRefInterface)
+		groups[group] = subscribers
+	}
+	subscribers[actorRef.Name()] = actorRef
+
+	m.publishSubscriptions()
+
+	return nil
+}
+
+//Unsubscribes an actor from a topic, whatever its group
+func (m *mediator) Unsubscribe(topic string, actorRef ActorRefInterface) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.remove(topic, actorRef.Name())
+	m.publishSubscriptions()
+}
+
+func (m *mediator) remove(topic string, name string) {
+	for group, subscribers := range m.topics[topic] {
+		delete(subscribers, name)
+		if len(subscribers) == 0 {
+			delete(m.topics[topic], group)
+		}
+	}
+	if len(m.topics[topic]) == 0 {
+		delete(m.topics, topic)
+	}
+}
+
+//Gossips the groups subscribed per topic with the metadata of the node
+func (m *mediator) publishSubscriptions() {
+	if m.cluster == nil || m.actor == nil {
+		return
+	}
+
+	topics := make(map[string][]string)
+	for topic, groups := range m.topics {
+		for group := range groups {
+			topics[topic] = append(topics[topic], group)
+		}
+		sort.Strings(topics[topic])
+	}
+	v, _ := json.Marshal(topics)
+
+	m.cluster.SetMetadata(pubsubTopicsMetadata, string(v))
+}
+
+//Returns the mediators of the other members subscribed to a topic, per group
+func (m *mediator) remoteSubscriptions(topic string) map[string][]string {
+	mediators := make(map[string][]string)
+	if m.cluster == nil {
+		return mediators
+	}
+
+	for _, member := range m.cluster.Members() {
+		name := member.Metadata[pubsubMediatorMetadata]
+		if member.Id == m.node || name == "" || member.Status != MemberStatusUp {
+			continue
+		}
+		if _, err := ActorSystem().ActorOf(name); err != nil {
+			continue
+		}
+
+		topics := make(map[string][]string)
+		err := json.Unmarshal([]byte(member.Metadata[pubsubTopicsMetadata]), &topics)
+		if err != nil {
+			continue
+		}
+		for _, group := range topics[topic] {
+			mediators[group] = append(mediators[group], name)
+		}
+	}
+
+	return mediators
+}
+
+//Publishes a message to the subscribers of a topic across the cluster
+func (m *mediator) Publish(context Context, topic string, messageType string, data interface{}, sender ActorRefInterface) error {
+	if sender == nil {
+		sender = m.ref
+	}
+	context.MessageType = messageType
+	context.Data = data
+	context.Sender = sender
+
+	remote := m.remoteSubscriptions(topic)
+
+	m.mutex.Lock()
+	groups := make(map[string]bool)
+	for group := range m.topics[topic] {
+		groups[group] = true
+	}
+	m.mutex.Unlock()
+	for group := range remote {
+		groups[group] = true
+	}
+
+	var err error
+	for group := range groups {
+		if group == "" {
+			m.deliver(topic, "", context)
+			for _, name := range remote[""] {
+				if e := m.forward(name, topic, "", context); e != nil {
+					err = e
+				}
+			}
+			continue
+		}
+
+		//One node of the group, this one included if subscribed
+		candidates := remote[group]
+		if m.subscribed(topic, group) {
+			candidates = append(candidates, "")
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		if name := candidates[rand.Intn(len(candidates))]; name == "" {
+			m.deliver(topic, group, context)
+		} else if e := m.forward(name, topic, group, context); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (m *mediator) subscribed(topic string, group string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, exists := m.topics[topic][group]
+
+	return exists
+}
+
+func (m *mediator) forward(name string, topic string, group string, context Context) error {
+	ref, err := ActorSystem().ActorOf(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(context.Data)
+	if err != nil {
+		ErrorLogger.Printf("Failed to encode message %v published to %v: %v", context.MessageType, topic, err)
+		return err
+	}
+	envelope, _ := json.Marshal(pubsubEnvelope{topic, group, context.MessageType, data})
+
+	return ref.Tell(context, GosirisMsgPublish, string(envelope), context.Sender)
+}
+
+func (m *mediator) receiveEnvelope(context Context) {
+	s, _ := context.Data.(string)
+	envelope := pubsubEnvelope{}
+	err := json.Unmarshal([]byte(s), &envelope)
+	if err != nil {
+		ErrorLogger.Printf("Invalid message published: %v", err)
+		return
+	}
+
+	var data interface{}
+	if len(envelope.Data) != 0 {
+		json.Unmarshal(envelope.Data, &data)
+	}
+
+	context.MessageType = envelope.MessageType
+	context.Data = data
+	context.Sender = entitySender(context.Sender)
+	m.deliver(envelope.Topic, envelope.Group, context)
+}
+
+//Tells the plain subscribers of a topic, or one subscriber of a group. The subscribers closed are removed.
+func (m *mediator) deliver(topic string, group string, context Context) {
+	m.mutex.Lock()
+	var refs []ActorRefInterface
+	for _, ref := range m.topics[topic][group] {
+		refs = append(refs, ref)
+	}
+	m.mutex.Unlock()
+
+	if group != "" && len(refs) != 0 {
+		refs = []ActorRefInterface{refs[rand.Intn(len(refs))]}
+	}
+
+	for _, ref := range refs {
+		err := ref.Tell(context, context.MessageType, context.Data, context.Sender)
+		if err == nil {
+			continue
+		}
+		if _, e := ActorSystem().actor(ref.Name()); e != nil {
+			InfoLogger.Printf("Subscriber %v of topic %v closed, unsubscribed", ref.Name(), topic)
+			m.mutex.Lock()
+			m.remove(topic, ref.Name())
+			m.publishSubscriptions()
+			m.mutex.Unlock()
+		}
+	}
+}
+
+func (m *mediator) close() {
+	if m.actor != nil {
+		m.cluster.SetMetadata(pubsubTopicsMetadata, "")
+		m.cluster.SetMetadata(pubsubMediatorMetadata, "")
+		m.actor.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package gosiris
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Subscribers replying with their name and the data of the orders received
+func registerSubscriber(t *testing.T, name string, replies chan string) ActorRefInterface {
+	actor := new(Actor).React("order", func(context Context) {
+		replies <- fmt.Sprintf("%v:%v", name, context.Data)
+	})
+	if err := ActorSystem().RegisterActor(name, actor, nil); err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := ActorSystem().ActorOf(name)
+
+	return ref
+}
+
+func receiveReplies(t *testing.T, replies chan string, n int) map[string]int {
+	received := make(map[string]int)
+	for i := 0; i < n; i++ {
+		received[receiveReply(t, replies)]++
+	}
+
+	select {
+	case reply := <-replies:
+		t.Errorf("Unexpected reply %v", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	return received
+}
+
+func TestPubSub(t *testing.T) {
+	t.Log("Starting pub/sub test")
+
+	err := InitActorSystem(SystemOptions{
+		ActorSystemName: "PubSubSystem",
+		RegistryUrl:     "mem://TestPubSub",
+		NodeId:          "pubsubNodeA",
+		ClusterOptions:  clusterTestOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseActorSystem()
+
+	remote := func() OptionsInterface {
+		return new(ActorOptions).SetRemoteType(Memory).SetUrl("TestPubSub")
+	}
+	if err := StartMediator(MediatorOptions{Remote: remote()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartMediator(MediatorOptions{Remote: remote()}); err == nil {
+		t.Errorf("Mediator started twice")
+	}
+	mediatorA := Mediator()
+
+	nodeB := newClusterTestNode(t, "pubsubNodeB", Cluster().Self().Address)
+	defer nodeB.stop()
+	mediatorB, err := newMediator(MediatorOptions{Remote: remote()}, nodeB, "pubsubNodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mediatorB.close()
+
+	replies := make(chan string, 100)
+	mediatorA.Subscribe("orders", registerSubscriber(t, "subscriberA", replies))
+	mediatorA.SubscribeGroup("orders", "workers", registerSubscriber(t, "workerA", replies))
+	subscriberB := registerSubscriber(t, "subscriberB", replies)
+	mediatorB.Subscribe("orders", subscriberB)
+	mediatorB.SubscribeGroup("orders", "workers", registerSubscriber(t, "workerB1", replies))
+	mediatorB.SubscribeGroup("orders", "workers", registerSubscriber(t, "workerB2", replies))
+
+	//Each node knows the subscriptions of the other once gossiped
+	for i := 0; ; i++ {
+		a := mediatorA.remoteSubscriptions("orders")
+		b := mediatorB.remoteSubscriptions("orders")
+		if len(a[""]) == 1 && len(a["workers"]) == 1 && len(b[""]) == 1 && len(b["workers"]) == 1 {
+			break
+		}
+		if i == 200 {
+			t.Fatal("Subscriptions not gossiped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//Every plain subscriber receives all the messages, and one worker of the group each message
+	for i := 0; i < 10; i++ {
+		if err := mediatorA.Publish(EmptyContext, "orders", "order", fmt.Sprint(i), nil); err != nil {
+			t.Error(err)
+		}
+	}
+	received := receiveReplies(t, replies, 30)
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"subscriberA", "subscriberB"} {
+			if received[fmt.Sprintf("%v:%v", name, i)] != 1 {
+				t.Errorf("Order %v not received once by %v: %v", i, name, received)
+			}
+		}
+		workers := 0
+		for _, name := range []string{"workerA", "workerB1", "workerB2"} {
+			workers += received[fmt.Sprintf("%v:%v", name, i)]
+		}
+		if workers != 1 {
+			t.Errorf("Order %v received by %v workers", i, workers)
+		}
+	}
+
+	//Published from the other node
+	mediatorB.Publish(EmptyContext, "orders", "order", "b", nil)
+	received = receiveReplies(t, replies, 3)
+	if received["subscriberA:b"] != 1 || received["subscriberB:b"] != 1 {
+		t.Errorf("Order published by node B not received: %v", received)
+	}
+
+	//Once unsubscribed, an actor no longer receives the messages
+	mediatorB.Unsubscribe("orders", subscriberB)
+	mediatorA.Publish(EmptyContext, "orders", "order", "c", nil)
+	for reply := range receiveReplies(t, replies, 2) {
+		if strings.HasPrefix(reply, "subscriberB") {
+			t.Errorf("Order received by an unsubscribed actor")
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package gosiris
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Transport options shared by the transports supporting reconnection
+const (
+	ReconnectInitial = "reconnect.initial" //First delay before reconnecting (default 100ms)
+	ReconnectMax     = "reconnect.max"     //Maximum delay between two attempts (default 30s)
+	ReconnectBuffer  = "reconnect.buffer"  //Number of messages buffered while disconnected (default 0: rejected)
+)
+
+const (
+	defaultReconnectInitial = 100 * time.Millisecond
+	defaultReconnectMax     = 30 * time.Second
+)
+
+var ErrTransportDisconnected = errors.New("transport disconnected")
+
+//Implemented by the transports able to recover from a connection loss
+type reconnectableTransport interface {
+	Reconnect()
+}
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.initial
+	} else {
+		b.current *= 2
+	}
+
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	return b.current
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+type pendingMessage struct {
+	destination string
+	context     Context
+	data        []byte
+}
+
+//Connection state shared by a transport, its receivers and its reconnection loop
+type connectionState struct {
+	name         string
+	connected    bool
+	reconnecting bool
+	closed       bool
+	up           chan struct{} //Closed once connected (or closed)
+	down         chan struct{} //Closed once the current connection is lost (or closed)
+	backoff      backoff
+	bufferSize   int
+	buffer       []pendingMessage
+	mutex        sync.Mutex
+}
+
+func newConnectionState() *connectionState {
+	return &connectionState{
+		up:      make(chan struct{}),
+		down:    make(chan struct{}),
+		backoff: backoff{initial: defaultReconnectInitial, max: defaultReconnectMax},
+	}
+}
+
+func (s *connectionState) configure(name string, options map[string]string) error {
+	s.name = name
+
+	var err error
+	if v, exists := options[ReconnectInitial]; exists {
+		s.backoff.initial, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, ReconnectInitial, err)
+		}
+	}
+
+	if v, exists := options[ReconnectMax]; exists {
+		s.backoff.max, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, ReconnectMax, err)
+		}
+	}
+
+	if v, exists := options[ReconnectBuffer]; exists {
+		s.bufferSize, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, ReconnectBuffer, err)
+		}
+	}
+
+	return nil
+}
+
+//Marks the connection as established and returns the messages buffered during the outage
+func (s *connectionState) established() []pendingMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.connected || s.closed {
+		return nil
+	}
+
+	s.connected = true
+	s.reconnecting = false
+	s.backoff.reset()
+	s.down = make(chan struct{})
+	close(s.up)
+
+	pending := s.buffer
+	s.buffer = nil
+
+	return pending
+}
+
+//Marks the connection as lost and starts reconnecting unless it is already the case
+func (s *connectionState) lost(connect func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.reconnecting {
+		return
+	}
+
+	if s.connected {
+		ErrorLogger.Printf("Connection to %v lost", s.name)
+		s.connected = false
+		s.up = make(chan struct{})
+		close(s.down)
+	}
+	s.reconnecting = true
+
+	go s.reconnect(connect)
+}
+
+func (s *connectionState) reconnect(connect func() error) {
+	for {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return
+		}
+		d := s.backoff.next()
+		s.mutex.Unlock()
+
+		InfoLogger.Printf("Reconnecting to %v in %v", s.name, d)
+		time.Sleep(d)
+
+		err := connect()
+		if err == nil {
+			InfoLogger.Printf("Reconnected to %v", s.name)
+			return
+		}
+		ErrorLogger.Printf("Failed to reconnect to %v: %v", s.name, err)
+	}
+}
+
+//Blocks until the transport is connected and returns a channel closed when the connection is lost.
+//It returns false once the transport is closed.
+func (s *connectionState) wait() (<-chan struct{}, bool) {
+	for {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return nil, false
+		}
+		if s.connected {
+			down := s.down
+			s.mutex.Unlock()
+			return down, true
+		}
+		up := s.up
+		s.mutex.Unlock()
+
+		<-up
+	}
+}
+
+//Buffers a message while disconnected, returns false if the transport is connected
+func (s *connectionState) hold(destination string, context Context, data []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return true, ErrTransportDisconnected
+	}
+
+	if s.connected {
+		return false, nil
+	}
+
+	if len(s.buffer) >= s.bufferSize {
+		ErrorLogger.Printf("Message to %v rejected, %v is disconnected", destination, s.name)
+		return true, ErrTransportDisconnected
+	}
+
+	s.buffer = append(s.buffer, pendingMessage{destination, context, data})
+	InfoLogger.Printf("Message to %v buffered until %v reconnects", destination, s.name)
+
+	return true, nil
+}
+
+func (s *connectionState) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	if s.connected {
+		close(s.down)
+	} else {
+		close(s.up)
+	}
+}
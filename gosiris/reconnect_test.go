@@ -0,0 +1,75 @@
+package gosiris
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Log("Starting backoff test")
+
+	b := backoff{initial: 10 * time.Millisecond, max: 50 * time.Millisecond}
+
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for _, v := range expected {
+		if d := b.next(); d != v*time.Millisecond {
+			t.Errorf("Expected %v, got %v", v*time.Millisecond, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d != 10*time.Millisecond {
+		t.Errorf("Expected the initial delay after a reset, got %v", d)
+	}
+}
+
+func TestReconnection(t *testing.T) {
+	t.Log("Starting reconnection test")
+
+	s := newConnectionState()
+	s.configure("test", map[string]string{ReconnectInitial: "20ms", ReconnectBuffer: "1"})
+	s.established()
+
+	lost, _ := s.wait()
+
+	attempts := 0
+	var connect func() error
+	connect = func() error {
+		attempts++
+		if attempts < 3 {
+			return ErrTransportDisconnected
+		}
+		pending := s.established()
+		if len(pending) != 1 || pending[0].destination != "buffered" {
+			t.Errorf("Unexpected buffered messages %v", pending)
+		}
+		return nil
+	}
+	s.lost(connect)
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("Connection loss not notified")
+	}
+
+	held, err := s.hold("buffered", EmptyContext, nil)
+	if !held || err != nil {
+		t.Errorf("Message expected to be buffered: %v", err)
+	}
+	held, err = s.hold("rejected", EmptyContext, nil)
+	if !held || err != ErrTransportDisconnected {
+		t.Errorf("Message expected to be rejected: %v", err)
+	}
+
+	_, ok := s.wait()
+	if !ok || attempts != 3 {
+		t.Errorf("Expected to be reconnected after 3 attempts, got %v", attempts)
+	}
+
+	s.close()
+	_, ok = s.wait()
+	if ok {
+		t.Errorf("Closed state expected")
+	}
+}
@@ -1,5 +1,20 @@
 package gosiris
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	actors_configuration   = "/gosiris/actor/"
+	electionsConfiguration = "/gosiris/election/"
+	prefix                 = "gosiris://"
+	delimiter              = "#"
+)
+
 type registryInterface interface {
 	Configure(...string) error
 	Close()
@@ -7,4 +22,256 @@ type registryInterface interface {
 	Watch(func(string, *ActorOptions), func(string)) error
 	UnregisterActor(string) error
 	ParseConfiguration() (map[string]OptionsInterface, error)
+	setNamespace(registryNamespace)
+}
+
+//Implemented by the registries able to elect a leader among the actor systems, e.g. to run a singleton.
+//A candidate campaigns until the returned function is called, resigning if elected. The node id of the leader
+//is sent to the channel each time it changes ("" while there is none), a candidate "" only observing the election.
+type registryElection interface {
+	elect(election string, candidate string, leaders chan<- string) (func(), error)
+}
+
+const defaultNamespace = "default"
+
+//The actors of a namespace are stored under /gosiris/actor/<namespace>/, the registries being scoped to their namespace.
+//If all is set, the actors of the other namespaces are discovered too, named <namespace>/<actor>.
+type registryNamespace struct {
+	namespace string
+	all       bool
+}
+
+func (n *registryNamespace) setNamespace(namespace registryNamespace) {
+	*n = namespace
+}
+
+//Key of an actor of the namespace
+func (n *registryNamespace) key(name string) string {
+	return actors_configuration + n.relativeKey(name)
+}
+
+//Key of an actor relative to actors_configuration
+func (n *registryNamespace) relativeKey(name string) string {
+	return n.namespace + "/" + name
+}
+
+//Prefix of the keys of the actors discovered
+func (n *registryNamespace) prefix() string {
+	if n.all {
+		return actors_configuration
+	}
+
+	return actors_configuration + n.namespace + "/"
+}
+
+//Name of the actor stored under a key relative to actors_configuration, false if the actor is not discovered
+func (n *registryNamespace) actorName(key string) (string, bool) {
+	i := strings.Index(key, "/")
+	if i == -1 {
+		return "", false
+	}
+
+	if key[:i] == n.namespace {
+		return key[i+1:], true
+	}
+
+	return key, n.all
+}
+
+var registryTypes = make(map[string]func() registryInterface)
+
+func registerRegistry(scheme string, f func() registryInterface) {
+	registryTypes[scheme] = f
+}
+
+//The registry is selected by the scheme of the url, e.g. consul://consul:8500
+func newRegistry(u string, namespace registryNamespace) (registryInterface, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry url %v: %v", u, err)
+	}
+
+	f, exists := registryTypes[parsed.Scheme]
+	if !exists {
+		return nil, fmt.Errorf("no registry supporting the scheme %v of %v", parsed.Scheme, u)
+	}
+
+	if namespace.namespace == "" {
+		namespace.namespace = defaultNamespace
+	}
+	if strings.Contains(namespace.namespace, "/") {
+		return nil, fmt.Errorf("invalid registry namespace %v", namespace.namespace)
+	}
+
+	r := f()
+	r.setNamespace(namespace)
+	err = r.Configure(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+//Version of the registry records written by this version of gosiris
+const registryRecordVersion = 1
+
+//Registry entry of an actor, stored as JSON. The entries written before the records were versioned
+//(parent#remoteType#url#destination[#transportOptions]) are still read, as version 0, and migrated by the etcd registry.
+type registryRecord struct {
+	Version          int               `json:"version" yaml:"version"`
+	Parent           string            `json:"parent,omitempty" yaml:"parent"`
+	RemoteType       string            `json:"remoteType" yaml:"remoteType"`
+	Url              string            `json:"url" yaml:"url"`
+	Destination      string            `json:"destination" yaml:"destination"`
+	TransportOptions map[string]string `json:"transportOptions,omitempty" yaml:"transportOptions"`
+	Labels           map[string]string `json:"labels,omitempty" yaml:"labels"`
+	Node             string            `json:"node,omitempty" yaml:"node"`
+	BufferSize       int               `json:"bufferSize,omitempty" yaml:"bufferSize"`
+	Autoclose        *bool             `json:"autoclose,omitempty" yaml:"autoclose"` //Absent from the records written before, true if so
+	Registered       time.Time         `json:"registered" yaml:"registered"`
+}
+
+func newRegistryRecord(options OptionsInterface) registryRecord {
+	autoclose := options.Autoclose()
+
+	return registryRecord{
+		Version:          registryRecordVersion,
+		Parent:           options.Parent(),
+		RemoteType:       options.RemoteType(),
+		Url:              options.Url(),
+		Destination:      options.Destination(),
+		TransportOptions: publishedTransportOptions(options.TransportOptions()),
+		Labels:           options.Labels(),
+		Node:             nodeId,
+		BufferSize:       options.BufferSize(),
+		Autoclose:        &autoclose,
+		Registered:       time.Now().UTC(),
+	}
+}
+
+func (record registryRecord) options() *ActorOptions {
+	options := &ActorOptions{
+		parent:      record.Parent,
+		remote:      true,
+		autoclose:   record.Autoclose == nil || *record.Autoclose,
+		remoteType:  record.RemoteType,
+		url:         record.Url,
+		destination: record.Destination,
+		bufferSize:  record.BufferSize,
+		node:        record.Node,
+	}
+	for key, value := range record.TransportOptions {
+		options.SetTransportOption(key, value)
+	}
+	for key, value := range record.Labels {
+		options.SetLabel(key, value)
+	}
+
+	return options
+}
+
+func encodeRegistryEntry(options OptionsInterface) string {
+	v, _ := json.Marshal(newRegistryRecord(options))
+
+	return string(v)
+}
+
+func decodeRegistryEntry(name string, v string) (*ActorOptions, error) {
+	record, err := decodeRegistryRecord(name, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.options(), nil
+}
+
+func decodeRegistryRecord(name string, v string) (registryRecord, error) {
+	record := registryRecord{}
+
+	if !strings.HasPrefix(v, "{") {
+		return decodeLegacyRegistryRecord(name, v)
+	}
+
+	err := json.Unmarshal([]byte(v), &record)
+	if err != nil {
+		return record, fmt.Errorf("invalid registry entry %v for actor %v: %v", v, name, err)
+	}
+
+	//The records are only extended with optional fields within a version
+	if record.Version > registryRecordVersion {
+		return record, fmt.Errorf("unsupported version %v of the registry entry of actor %v", record.Version, name)
+	}
+
+	return record, nil
+}
+
+func decodeLegacyRegistryRecord(name string, v string) (registryRecord, error) {
+	record := registryRecord{}
+
+	a := strings.Split(v, delimiter)
+	if len(a) < 4 {
+		return record, fmt.Errorf("invalid registry entry %v for actor %v", v, name)
+	}
+
+	record.Parent = a[0]
+	record.RemoteType = a[1]
+	record.Url = a[2]
+	record.Destination = a[3]
+
+	//The transport options are encoded as url parameters
+	if len(a) > 4 {
+		values, err := url.ParseQuery(a[4])
+		if err != nil {
+			ErrorLogger.Printf("Failed to parse the transport options of %v: %v", name, err)
+		}
+		record.TransportOptions = make(map[string]string)
+		for key := range values {
+			record.TransportOptions[key] = values.Get(key)
+		}
+	}
+
+	return record, nil
+}
+
+//Decodes a snapshot of the registry, the invalid entries being ignored
+func decodeRegistryEntries(entries map[string]string) map[string]OptionsInterface {
+	conf := make(map[string]OptionsInterface)
+
+	for k, v := range entries {
+		options, err := decodeRegistryEntry(k, v)
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			continue
+		}
+		conf[k] = options
+	}
+
+	return conf
+}
+
+//Notifies the differences between two snapshots of the registry (actor name -> entry),
+//used by the registries polling or listing their entries instead of receiving events
+func notifyRegistryChanges(previous map[string]string, current map[string]string, cbCreate func(string, *ActorOptions), cbDelete func(string)) {
+	for k := range previous {
+		if _, exists := current[k]; !exists {
+			InfoLogger.Printf("Actor %v removed from the registry", k)
+			cbDelete(k)
+		}
+	}
+
+	for k, v := range current {
+		if p, exists := previous[k]; exists && p == v {
+			continue
+		}
+
+		options, err := decodeRegistryEntry(k, v)
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			continue
+		}
+
+		InfoLogger.Printf("New actor %v added to the registry", k)
+		cbCreate(k, options)
+	}
 }
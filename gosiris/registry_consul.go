@@ -0,0 +1,160 @@
+package gosiris
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	consulWaitTime = 5 * time.Minute
+)
+
+//The actors are stored in the Consul KV store, e.g. consul://consul:8500?token=secret&dc=eu&scheme=https
+type consulClient struct {
+	registryNamespace
+	kv     *api.KV
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func init() {
+	registerRegistry("consul", newConsulClient)
+}
+
+func newConsulClient() registryInterface {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &consulClient{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (consulClient *consulClient) Configure(urls ...string) error {
+	if len(urls) == 0 {
+		return fmt.Errorf("no Consul url")
+	}
+
+	u, err := url.Parse(urls[0])
+	if err != nil {
+		return fmt.Errorf("invalid Consul url %v: %v", urls[0], err)
+	}
+
+	config := api.DefaultConfig()
+	config.Address = u.Host
+	config.Token = u.Query().Get("token")
+	config.Datacenter = u.Query().Get("dc")
+	if scheme := u.Query().Get("scheme"); scheme != "" {
+		config.Scheme = scheme
+	}
+
+	c, err := api.NewClient(config)
+	if err != nil {
+		ErrorLogger.Printf("Consul connection error %v", err)
+		return err
+	}
+	consulClient.kv = c.KV()
+
+	return nil
+}
+
+func (consulClient *consulClient) Close() {
+	consulClient.cancel()
+}
+
+//Blocking queries return once the actors have changed (or after consulWaitTime), each result being compared with the previous one
+func (consulClient *consulClient) Watch(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	var previous map[string]string
+	var index uint64
+	for {
+		current, next, err := consulClient.list(index)
+		if err != nil {
+			if consulClient.ctx.Err() != nil {
+				return nil
+			}
+
+			d := b.next()
+			ErrorLogger.Printf("Consul watch error, retrying in %v: %v", d, err)
+			select {
+			case <-time.After(d):
+				continue
+			case <-consulClient.ctx.Done():
+				return nil
+			}
+		}
+		b.reset()
+
+		//The index must be reset if it goes backwards (e.g. Consul snapshot restore)
+		if next < index {
+			next = 0
+		}
+
+		//The first result is the state already parsed at startup
+		if index != 0 {
+			notifyRegistryChanges(previous, current, cbCreate, cbDelete)
+		}
+		previous = current
+		index = next
+	}
+}
+
+func (consulClient *consulClient) list(index uint64) (map[string]string, uint64, error) {
+	options := &api.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  consulWaitTime,
+	}
+
+	pairs, meta, err := consulClient.kv.List(consulKey(consulClient.prefix()), options.WithContext(consulClient.ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[string]string)
+	for _, pair := range pairs {
+		k, discovered := consulClient.actorName(strings.TrimPrefix(pair.Key, consulKey(actors_configuration)))
+		if discovered {
+			entries[k] = string(pair.Value)
+		}
+	}
+
+	return entries, meta.LastIndex, nil
+}
+
+func (consulClient *consulClient) ParseConfiguration() (map[string]OptionsInterface, error) {
+	entries, _, err := consulClient.list(0)
+	if err != nil {
+		ErrorLogger.Printf("Consul list %v error %v", consulClient.prefix(), err)
+		return nil, err
+	}
+
+	return decodeRegistryEntries(entries), nil
+}
+
+func (consulClient *consulClient) RegisterActor(name string, options OptionsInterface) error {
+	k := consulKey(consulClient.key(name))
+
+	_, err := consulClient.kv.Put(&api.KVPair{Key: k, Value: []byte(encodeRegistryEntry(options))}, nil)
+	if err != nil {
+		ErrorLogger.Printf("Failed to register actor %v: %v", k, err)
+		return err
+	}
+
+	return nil
+}
+
+func (consulClient *consulClient) UnregisterActor(name string) error {
+	_, err := consulClient.kv.Delete(consulKey(consulClient.key(name)), nil)
+
+	return err
+}
+
+//The Consul keys do not start with a slash
+func consulKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
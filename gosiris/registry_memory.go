@@ -0,0 +1,296 @@
+package gosiris
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+var memoryStores = make(map[string]*memoryStore)
+var memoryStoresMutex sync.Mutex
+
+//In-process registry shared by the clients configured with the same name, e.g. mem://cluster.
+//The candidates of an election are queued, the leader being the first one.
+type memoryStore struct {
+	entries   map[string]string
+	elections map[string][]string
+	watchers  map[chan struct{}]bool
+	mutex     sync.Mutex
+}
+
+//The actors registered and the campaigns of a client are removed when it is closed, as if its actor system had died
+type memoryRegistry struct {
+	registryNamespace
+	store     *memoryStore
+	actors    map[string]bool
+	campaigns map[string]string
+	entries   map[string]string
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+func init() {
+	registerRegistry("mem", newMemoryRegistry)
+}
+
+func newMemoryRegistry() registryInterface {
+	return &memoryRegistry{
+		actors:    make(map[string]bool),
+		campaigns: make(map[string]string),
+		done:      make(chan struct{}),
+	}
+}
+
+func memoryStoreOf(name string) *memoryStore {
+	memoryStoresMutex.Lock()
+	defer memoryStoresMutex.Unlock()
+
+	s, exists := memoryStores[name]
+	if !exists {
+		s = &memoryStore{
+			entries:   make(map[string]string),
+			elections: make(map[string][]string),
+			watchers:  make(map[chan struct{}]bool),
+		}
+		memoryStores[name] = s
+	}
+
+	return s
+}
+
+func (s *memoryStore) set(key string, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries[key] = value
+	s.notify()
+}
+
+func (s *memoryStore) delete(keys ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	s.notify()
+}
+
+func (s *memoryStore) campaign(election string, candidate string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.elections[election] = append(s.elections[election], candidate)
+	s.notify()
+}
+
+func (s *memoryStore) resign(election string, candidate string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	candidates := s.elections[election]
+	for i, c := range candidates {
+		if c == candidate {
+			s.elections[election] = append(candidates[:i:i], candidates[i+1:]...)
+			break
+		}
+	}
+	s.notify()
+}
+
+func (s *memoryStore) leader(election string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if candidates := s.elections[election]; len(candidates) != 0 {
+		return candidates[0]
+	}
+
+	return ""
+}
+
+//The watchers are signaled without blocking, a pending signal covering the following changes
+func (s *memoryStore) notify() {
+	for w := range s.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *memoryStore) watch(w chan struct{}, b bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if b {
+		s.watchers[w] = true
+	} else {
+		delete(s.watchers, w)
+	}
+}
+
+func (memoryRegistry *memoryRegistry) Configure(urls ...string) error {
+	if len(urls) == 0 {
+		return fmt.Errorf("no memory registry url")
+	}
+
+	u, err := url.Parse(urls[0])
+	if err != nil {
+		return fmt.Errorf("invalid memory registry url %v: %v", urls[0], err)
+	}
+	memoryRegistry.store = memoryStoreOf(u.Host + u.Path)
+
+	return nil
+}
+
+func (memoryRegistry *memoryRegistry) Close() {
+	memoryRegistry.mutex.Lock()
+	defer memoryRegistry.mutex.Unlock()
+
+	select {
+	case <-memoryRegistry.done:
+		return
+	default:
+		close(memoryRegistry.done)
+	}
+
+	keys := make([]string, 0, len(memoryRegistry.actors))
+	for k := range memoryRegistry.actors {
+		keys = append(keys, k)
+	}
+	memoryRegistry.store.delete(keys...)
+
+	for election, candidate := range memoryRegistry.campaigns {
+		memoryRegistry.store.resign(election, candidate)
+	}
+}
+
+func (memoryRegistry *memoryRegistry) Watch(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
+	w := make(chan struct{}, 1)
+	memoryRegistry.store.watch(w, true)
+	defer memoryRegistry.store.watch(w, false)
+
+	memoryRegistry.mutex.Lock()
+	previous := memoryRegistry.entries
+	memoryRegistry.mutex.Unlock()
+	if previous == nil {
+		previous = memoryRegistry.list()
+	}
+	//The changes made before the watcher was added
+	w <- struct{}{}
+
+	for {
+		select {
+		case <-w:
+			current := memoryRegistry.list()
+			notifyRegistryChanges(previous, current, cbCreate, cbDelete)
+			previous = current
+		case <-memoryRegistry.done:
+			return nil
+		}
+	}
+}
+
+func (memoryRegistry *memoryRegistry) list() map[string]string {
+	s := memoryRegistry.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make(map[string]string)
+	for k, v := range s.entries {
+		if name, discovered := memoryRegistry.actorName(k); discovered {
+			entries[name] = v
+		}
+	}
+
+	return entries
+}
+
+func (memoryRegistry *memoryRegistry) ParseConfiguration() (map[string]OptionsInterface, error) {
+	entries := memoryRegistry.list()
+
+	memoryRegistry.mutex.Lock()
+	memoryRegistry.entries = entries
+	memoryRegistry.mutex.Unlock()
+
+	return decodeRegistryEntries(entries), nil
+}
+
+func (memoryRegistry *memoryRegistry) RegisterActor(name string, options OptionsInterface) error {
+	k := memoryRegistry.relativeKey(name)
+
+	memoryRegistry.mutex.Lock()
+	memoryRegistry.actors[k] = true
+	memoryRegistry.mutex.Unlock()
+
+	memoryRegistry.store.set(k, encodeRegistryEntry(options))
+
+	return nil
+}
+
+func (memoryRegistry *memoryRegistry) UnregisterActor(name string) error {
+	k := memoryRegistry.relativeKey(name)
+
+	memoryRegistry.mutex.Lock()
+	delete(memoryRegistry.actors, k)
+	memoryRegistry.mutex.Unlock()
+
+	memoryRegistry.store.delete(k)
+
+	return nil
+}
+
+func (memoryRegistry *memoryRegistry) elect(election string, candidate string, leaders chan<- string) (func(), error) {
+	k := memoryRegistry.relativeKey(election)
+	s := memoryRegistry.store
+
+	w := make(chan struct{}, 1)
+	s.watch(w, true)
+	w <- struct{}{}
+
+	if candidate != "" {
+		memoryRegistry.mutex.Lock()
+		memoryRegistry.campaigns[k] = candidate
+		memoryRegistry.mutex.Unlock()
+		s.campaign(k, candidate)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer s.watch(w, false)
+
+		leader, first := "", true
+		for {
+			select {
+			case <-w:
+				current := s.leader(k)
+				if first || current != leader {
+					select {
+					case leaders <- current:
+					case <-done:
+						return
+					}
+					leader, first = current, false
+				}
+			case <-done:
+				return
+			case <-memoryRegistry.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			if candidate != "" {
+				memoryRegistry.mutex.Lock()
+				delete(memoryRegistry.campaigns, k)
+				memoryRegistry.mutex.Unlock()
+				s.resign(k, candidate)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,53 @@
+package gosiris
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	t.Log("Starting memory registry test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "MemoryRegistry",
+		RegistryUrl:     "mem://TestMemoryRegistry",
+	})
+	defer CloseActorSystem()
+
+	//Another actor system sharing the registry
+	node, err := newRegistry("mem://TestMemoryRegistry", registryNamespace{namespace: "MemoryRegistry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.RegisterActor("memoryBilling", new(ActorOptions).SetRemote(true).SetRemoteType(Unix).SetUrl(t.TempDir()+"/billing.sock").SetDestination("billing"))
+
+	discovered := func(name string, expected bool) {
+		for i := 0; i < 100; i++ {
+			_, err := ActorSystem().ActorOf(name)
+			if (err == nil) == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Actor %v discovered: %v expected", name, expected)
+	}
+	discovered("memoryBilling", true)
+
+	//The actors of a closed registry client are removed
+	node.Close()
+	discovered("memoryBilling", false)
+
+	//The actors of the other namespaces are not discovered
+	other, _ := newRegistry("mem://TestMemoryRegistry", registryNamespace{namespace: "Other"})
+	defer other.Close()
+	other.RegisterActor("memoryShipping", new(ActorOptions).SetRemote(true).SetRemoteType(Unix).SetUrl(t.TempDir()+"/shipping.sock").SetDestination("shipping"))
+
+	conf, _ := other.ParseConfiguration()
+	if _, exists := conf["memoryShipping"]; !exists {
+		t.Errorf("Actor not registered: %v", conf)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ActorSystem().ActorOf("memoryShipping"); err == nil {
+		t.Errorf("Actor of another namespace not expected to be discovered")
+	}
+}
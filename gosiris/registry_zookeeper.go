@@ -0,0 +1,241 @@
+package gosiris
+
+import (
+	"fmt"
+	"github.com/go-zookeeper/zk"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zookeeperSessionTimeout = 10 * time.Second
+)
+
+//The actors are ephemeral znodes, e.g. zk://zk1:2181,zk2:2181, removed by ZooKeeper once the session of their system expires.
+//The actors registered are kept to be created again in the session following an expiration.
+//The znodes of the actors are named after their escaped relative key (namespace%2Factor) so that all the namespaces can be watched at once.
+type zookeeperClient struct {
+	registryNamespace
+	conn   *zk.Conn
+	dir    string
+	actors map[string][]byte
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+func init() {
+	registerRegistry("zk", newZookeeperClient)
+}
+
+func newZookeeperClient() registryInterface {
+	return &zookeeperClient{
+		dir:    strings.TrimSuffix(actors_configuration, "/"),
+		actors: make(map[string][]byte),
+		done:   make(chan struct{}),
+	}
+}
+
+func (zookeeperClient *zookeeperClient) Configure(urls ...string) error {
+	var servers []string
+	for _, u := range urls {
+		for _, server := range strings.Split(strings.TrimPrefix(u, "zk://"), ",") {
+			servers = append(servers, strings.TrimSuffix(server, "/"))
+		}
+	}
+
+	conn, events, err := zk.Connect(servers, zookeeperSessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		ErrorLogger.Printf("ZooKeeper connection error %v", err)
+		return err
+	}
+	zookeeperClient.conn = conn
+
+	go zookeeperClient.session(events)
+
+	//Creates /gosiris then /gosiris/actor
+	path := ""
+	for _, node := range strings.Split(strings.TrimPrefix(zookeeperClient.dir, "/"), "/") {
+		path += "/" + node
+		_, err = conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			ErrorLogger.Printf("ZooKeeper create %v error %v", path, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (zookeeperClient *zookeeperClient) session(events <-chan zk.Event) {
+	expired := false
+	for e := range events {
+		switch e.State {
+		case zk.StateExpired:
+			ErrorLogger.Printf("ZooKeeper session expired")
+			expired = true
+		case zk.StateHasSession:
+			if expired {
+				expired = false
+				go zookeeperClient.restore()
+			}
+		}
+	}
+}
+
+func (zookeeperClient *zookeeperClient) restore() {
+	zookeeperClient.mutex.Lock()
+	defer zookeeperClient.mutex.Unlock()
+
+	for name, data := range zookeeperClient.actors {
+		err := zookeeperClient.create(name, data)
+		if err != nil {
+			ErrorLogger.Printf("Failed to register actor %v again: %v", name, err)
+		}
+	}
+}
+
+func (zookeeperClient *zookeeperClient) Close() {
+	zookeeperClient.mutex.Lock()
+	defer zookeeperClient.mutex.Unlock()
+
+	select {
+	case <-zookeeperClient.done:
+		return
+	default:
+		close(zookeeperClient.done)
+	}
+
+	if zookeeperClient.conn != nil {
+		zookeeperClient.conn.Close()
+	}
+}
+
+//Children watches are triggered once, each one being followed by a new listing compared with the previous one
+func (zookeeperClient *zookeeperClient) Watch(cbCreate func(string, *ActorOptions), cbDelete func(string)) error {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+
+	var previous map[string]string
+	for first := true; ; {
+		children, _, events, err := zookeeperClient.conn.ChildrenW(zookeeperClient.dir)
+		var current map[string]string
+		if err == nil {
+			current, err = zookeeperClient.values(children)
+		}
+
+		if err != nil {
+			d := b.next()
+			ErrorLogger.Printf("ZooKeeper watch error, retrying in %v: %v", d, err)
+			select {
+			case <-time.After(d):
+				continue
+			case <-zookeeperClient.done:
+				return nil
+			}
+		}
+		b.reset()
+
+		//The first listing is the state already parsed at startup
+		if !first {
+			notifyRegistryChanges(previous, current, cbCreate, cbDelete)
+		}
+		previous = current
+		first = false
+
+		select {
+		case <-events:
+		case <-zookeeperClient.done:
+			return nil
+		}
+	}
+}
+
+func (zookeeperClient *zookeeperClient) values(children []string) (map[string]string, error) {
+	entries := make(map[string]string)
+	for _, child := range children {
+		key, err := url.PathUnescape(child)
+		if err != nil {
+			continue
+		}
+		name, discovered := zookeeperClient.actorName(key)
+		if !discovered {
+			continue
+		}
+
+		data, _, err := zookeeperClient.conn.Get(zookeeperClient.dir + "/" + child)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[name] = string(data)
+	}
+
+	return entries, nil
+}
+
+func (zookeeperClient *zookeeperClient) ParseConfiguration() (map[string]OptionsInterface, error) {
+	children, _, err := zookeeperClient.conn.Children(zookeeperClient.dir)
+	if err != nil {
+		ErrorLogger.Printf("ZooKeeper children %v error %v", zookeeperClient.dir, err)
+		return nil, err
+	}
+
+	entries, err := zookeeperClient.values(children)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRegistryEntries(entries), nil
+}
+
+func (zookeeperClient *zookeeperClient) RegisterActor(name string, options OptionsInterface) error {
+	zookeeperClient.mutex.Lock()
+	defer zookeeperClient.mutex.Unlock()
+
+	data := []byte(encodeRegistryEntry(options))
+	err := zookeeperClient.create(name, data)
+	if err != nil {
+		ErrorLogger.Printf("Failed to register actor %v: %v", name, err)
+		return err
+	}
+	zookeeperClient.actors[name] = data
+
+	return nil
+}
+
+//An ephemeral node cannot be updated by another session, it is replaced instead
+func (zookeeperClient *zookeeperClient) create(name string, data []byte) error {
+	path := zookeeperClient.path(name)
+
+	err := zookeeperClient.conn.Delete(path, -1)
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+
+	_, err = zookeeperClient.conn.Create(path, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		return fmt.Errorf("ZooKeeper create %v error %v", path, err)
+	}
+
+	return nil
+}
+
+func (zookeeperClient *zookeeperClient) UnregisterActor(name string) error {
+	zookeeperClient.mutex.Lock()
+	delete(zookeeperClient.actors, name)
+	zookeeperClient.mutex.Unlock()
+
+	err := zookeeperClient.conn.Delete(zookeeperClient.path(name), -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+
+	return err
+}
+
+func (zookeeperClient *zookeeperClient) path(name string) string {
+	return zookeeperClient.dir + "/" + url.PathEscape(zookeeperClient.relativeKey(name))
+}
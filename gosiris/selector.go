@@ -0,0 +1,157 @@
+package gosiris
+
+import (
+	"fmt"
+	"strings"
+)
+
+//A selector is a comma separated list of requirements on the labels of the actors, all of them to be met:
+//
+//	role=billing            label equal to a value (== is accepted too)
+//	region!=eu              label missing or different from a value
+//	region in (eu,us)       label equal to one of the values
+//	region notin (eu,us)    label missing or different from all the values
+//	tier                    label set, whatever its value
+//	!canary                 label not set
+type selector []requirement
+
+type requirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorExists    = "exists"
+	selectorNotExists = "!exists"
+)
+
+func parseSelector(s string) (selector, error) {
+	var sel selector
+
+	for _, r := range splitSelector(s) {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		req, err := parseRequirement(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %v: %v", s, err)
+		}
+		sel = append(sel, req)
+	}
+
+	return sel, nil
+}
+
+//Splits the requirements on the commas outside of the sets of values
+func splitSelector(s string) []string {
+	var requirements []string
+
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(requirements, s[start:])
+}
+
+func parseRequirement(r string) (requirement, error) {
+	if i := strings.Index(r, "!="); i != -1 {
+		return newRequirement(r[:i], selectorNotEquals, r[i+2:])
+	}
+	if i := strings.Index(r, "=="); i != -1 {
+		return newRequirement(r[:i], selectorEquals, r[i+2:])
+	}
+	if i := strings.Index(r, "="); i != -1 {
+		return newRequirement(r[:i], selectorEquals, r[i+1:])
+	}
+
+	if i := strings.Index(r, "("); i != -1 {
+		if !strings.HasSuffix(r, ")") {
+			return requirement{}, fmt.Errorf("unclosed set of values in %v", r)
+		}
+
+		fields := strings.Fields(r[:i])
+		if len(fields) != 2 || (fields[1] != selectorIn && fields[1] != selectorNotIn) {
+			return requirement{}, fmt.Errorf("expected key in (values) or key notin (values) instead of %v", r)
+		}
+
+		var values []string
+		for _, v := range strings.Split(r[i+1:len(r)-1], ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		return requirement{key: fields[0], operator: fields[1], values: values}, nil
+	}
+
+	if strings.HasPrefix(r, "!") {
+		return newRequirement(r[1:], selectorNotExists)
+	}
+
+	return newRequirement(r, selectorExists)
+}
+
+func newRequirement(key string, operator string, values ...string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " ()!=") {
+		return requirement{}, fmt.Errorf("invalid label %v", key)
+	}
+
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+
+	return requirement{key: key, operator: operator, values: values}, nil
+}
+
+func (sel selector) matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	v, exists := labels[r.key]
+
+	switch r.operator {
+	case selectorEquals, selectorIn:
+		return exists && containsValue(r.values, v)
+	case selectorNotEquals, selectorNotIn:
+		return !exists || !containsValue(r.values, v)
+	case selectorExists:
+		return exists
+	case selectorNotExists:
+		return !exists
+	}
+
+	return false
+}
+
+func containsValue(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package gosiris
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	t.Log("Starting selector test")
+
+	labels := map[string]string{"role": "billing", "region": "eu", "tier": "1"}
+
+	for s, expected := range map[string]bool{
+		"":                               true,
+		"role=billing":                   true,
+		"role==billing, region=eu":       true,
+		"role=billing,region=us":         false,
+		"region!=us":                     true,
+		"canary!=true":                   true,
+		"region in (eu, us),tier":        true,
+		"region notin (eu,us)":           false,
+		"!canary":                        true,
+		"!tier":                          false,
+		"role=billing,region in (us)":    false,
+		"role in (billing),!canary,tier": true,
+	} {
+		sel, err := parseSelector(s)
+		if err != nil {
+			t.Errorf("Selector %v rejected: %v", s, err)
+			continue
+		}
+		if sel.matches(labels) != expected {
+			t.Errorf("Selector %v expected to match: %v", s, expected)
+		}
+	}
+
+	for _, s := range []string{"=billing", "region in (eu", "region within (eu)", "role billing"} {
+		_, err := parseSelector(s)
+		if err == nil {
+			t.Errorf("Invalid selector %v expected to be rejected", s)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	t.Log("Starting find test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "Find",
+		RegistryUrl:     "mem://TestFind",
+	})
+	defer CloseActorSystem()
+
+	local := new(Actor)
+	defer local.Close()
+	ActorSystem().RegisterActor("findLocal", local, new(ActorOptions).SetLabel("role", "billing").SetLabel("region", "us"))
+
+	node, _ := newRegistry("mem://TestFind", registryNamespace{namespace: "Find"})
+	defer node.Close()
+	options := new(ActorOptions).SetRemote(true).SetRemoteType(Unix).SetUrl(t.TempDir()+"/billing.sock").SetDestination("billing").SetLabel("role", "billing").SetLabel("region", "eu")
+	node.RegisterActor("findRemote", options)
+
+	found := func(s string, expected ...string) {
+		var refs []ActorRefInterface
+		for i := 0; i < 100; i++ {
+			var err error
+			refs, err = ActorSystem().Find(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(refs) == len(expected) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if len(refs) != len(expected) {
+			t.Fatalf("Actors %v expected to match %v, got %v", expected, s, refs)
+		}
+		for i, ref := range refs {
+			if ref.Name() != expected[i] {
+				t.Errorf("Actors %v expected to match %v, got %v", expected, s, refs)
+			}
+		}
+	}
+
+	found("role=billing", "findLocal", "findRemote")
+	found("role=billing,region=eu", "findRemote")
+
+	//The labels are updated through the registry
+	options.SetLabel("region", "us")
+	node.RegisterActor("findRemote", options)
+	found("region=eu")
+	found("region=us", "findLocal", "findRemote")
+
+	node.UnregisterActor("findRemote")
+	found("role=billing", "findLocal")
+
+	_, err := ActorSystem().Find("region in (eu")
+	if err == nil {
+		t.Errorf("Invalid selector expected to be rejected")
+	}
+}
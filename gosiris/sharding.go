@@ -0,0 +1,681 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNumberOfShards     = 100
+	defaultPassivationTimeout = 2 * time.Minute
+	shardRegionTick           = time.Second
+	shardRegionMetadata       = "gosiris.shardRegion." //Member metadata naming the region actor of a type of entities
+)
+
+var shardRegions = make(map[string]*shardRegion)
+var shardRegionsMutex sync.Mutex
+
+type ShardingOptions struct {
+	EntityId           func(Context) string //Extracts the identifier of the entity a message is sent to
+	ShardId            func(Context) string //Extracts the shard of the entity (default: hash of the entity id modulo NumberOfShards)
+	NumberOfShards     int                  //Used by the default ShardId (default: 100)
+	Entity             func(string) *Actor  //Creates the entity of an identifier on its first message, nil if it cannot be created
+	PassivationTimeout time.Duration        //Idle time after which an entity is stopped (default: 2m, negative to keep the entities)
+	Remote             OptionsInterface     //Transport the region of this node is reached through by the other members, required in a cluster (its destination being set by gosiris)
+}
+
+//Message forwarded to the region of the node owning the shard, the data being JSON encoded
+type shardEnvelope struct {
+	EntityId    string          `json:"entityId"`
+	ShardId     string          `json:"shardId"`
+	MessageType string          `json:"messageType"`
+	Data        json.RawMessage `json:"data"`
+}
+
+type shardEntity struct {
+	actor    *Actor
+	ref      ActorRefInterface
+	shardId  string
+	last     time.Time
+	starting bool //Placeholder of an entity being created, its actor and reference not set yet
+	stopping bool
+	pending  []Context //Messages received while the entity is starting or stopping, told once started or routed again once stopped
+}
+
+//Message of a shard whose home is requested to the coordinator
+type shardPending struct {
+	entityId string
+	context  Context
+}
+
+//A region routes the messages of a type of entities, telling it as if it was an actor. Each message is routed to the
+//node owning the shard of its entity, the entity being spawned on its first message (named type/entityId) then
+//passivated once idle. In a cluster, the home of a shard is requested to the coordinator elected among the regions
+//of the same type (see shardCoordinator), the messages of the shard being buffered meanwhile. An entity is only
+//activated by the region its shard is allocated to. The entities of the shards handed off to another node are
+//stopped, their state being lost unless persisted by the entities.
+type shardRegion struct {
+	ActorRef
+	typeName     string
+	options      ShardingOptions
+	cluster      *cluster
+	node         string
+	regionActor  *Actor
+	entities     map[string]*shardEntity
+	leader       string                    //Node of the coordinator, empty while not elected
+	coordinator  *shardCoordinator         //Set while this node is the coordinator
+	owners       map[string]string         //Home of the shards, as allocated by the coordinator
+	waiting      map[string][]shardPending //Messages of the shards whose home is requested
+	stopElection func()
+	leaders      chan string
+	registration sync.Mutex //Orders the shards registered with the hand-offs confirmed
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+//Starts the region of a type of entities on this node. The messages told to the region are routed to the entities
+//across the nodes of the cluster running the same region, the region being local if the actor system is not clustered.
+//The data of a message routed to another node is received JSON decoded by the entity (e.g. a struct as a map).
+func StartSharding(typeName string, options ShardingOptions) (ActorRefInterface, error) {
+	shardRegionsMutex.Lock()
+	defer shardRegionsMutex.Unlock()
+
+	if _, exists := shardRegions[typeName]; exists {
+		return nil, fmt.Errorf("sharding of %v already started", typeName)
+	}
+	if options.EntityId == nil {
+		return nil, fmt.Errorf("sharding of %v requires an entity id extractor", typeName)
+	}
+
+	election, _ := registry.(registryElection)
+	region, err := newShardRegion(typeName, options, clusterInstance, election, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	shardRegions[typeName] = region
+
+	return region, nil
+}
+
+//Returns the region of a type of entities started on this node
+func ShardRegion(typeName string) (ActorRefInterface, error) {
+	shardRegionsMutex.Lock()
+	defer shardRegionsMutex.Unlock()
+
+	region, exists := shardRegions[typeName]
+	if !exists {
+		return nil, fmt.Errorf("sharding of %v not started", typeName)
+	}
+
+	return region, nil
+}
+
+func closeShardRegions() {
+	shardRegionsMutex.Lock()
+	defer shardRegionsMutex.Unlock()
+
+	for typeName, region := range shardRegions {
+		region.close()
+		delete(shardRegions, typeName)
+	}
+}
+
+func newShardRegion(typeName string, options ShardingOptions, c *cluster, election registryElection, node string) (*shardRegion, error) {
+	if options.Entity == nil {
+		return nil, fmt.Errorf("sharding of %v requires an entity factory", typeName)
+	}
+	if c != nil && options.Remote == nil {
+		return nil, fmt.Errorf("sharding of %v requires a remote transport in a cluster", typeName)
+	}
+	if c != nil && election == nil {
+		return nil, fmt.Errorf("sharding of %v requires a registry supporting the elections in a cluster", typeName)
+	}
+	if options.NumberOfShards == 0 {
+		options.NumberOfShards = defaultNumberOfShards
+	}
+	if options.PassivationTimeout == 0 {
+		options.PassivationTimeout = defaultPassivationTimeout
+	}
+
+	region := &shardRegion{
+		ActorRef: newActorRef(typeName).(ActorRef),
+		typeName: typeName,
+		options:  options,
+		cluster:  c,
+		node:     node,
+		entities: make(map[string]*shardEntity),
+		owners:   make(map[string]string),
+		waiting:  make(map[string][]shardPending),
+		leaders:  make(chan string),
+		done:     make(chan struct{}),
+	}
+
+	if c != nil {
+		name := shardRegionName(typeName, node)
+		region.regionActor = new(Actor).React(GosirisMsgShardEnvelope, region.receiveEnvelope).
+			React(GosirisMsgShardHome, region.receiveHome).
+			React(GosirisMsgShardHandOff, region.receiveHandOff).
+			React(GosirisMsgShardRegister, region.receiveCoordination).
+			React(GosirisMsgShardGetHome, region.receiveCoordination).
+			React(GosirisMsgShardStopped, region.receiveCoordination)
+		err := ActorSystem().RegisterActor(name, region.regionActor, options.Remote.SetRemote(true).SetDestination(name))
+		if err != nil {
+			return nil, err
+		}
+		c.SetMetadata(shardRegionMetadata+typeName, name)
+
+		region.stopElection, err = election.elect(shardCoordinatorElection+typeName, node, region.leaders)
+		if err != nil {
+			region.regionActor.Close()
+			c.SetMetadata(shardRegionMetadata+typeName, "")
+			return nil, err
+		}
+
+		c.subscribe(func(messageType string, member Member) {
+			if messageType == GosirisMsgMemberUp || messageType == GosirisMsgMemberRemoved {
+				region.rebalance()
+			}
+		})
+	}
+
+	go region.run()
+
+	InfoLogger.Printf("Sharding of %v started on %v", typeName, node)
+
+	return region, nil
+}
+
+func shardRegionName(typeName string, node string) string {
+	return typeName + "@" + node
+}
+
+func (region *shardRegion) Tell(context Context, messageType string, data interface{}, sender ActorRefInterface) error {
+	context.MessageType = messageType
+	context.Data = data
+	context.Sender = sender
+	context.Self = region
+
+	return region.route(context)
+}
+
+func (region *shardRegion) Repeat(messageType string, d time.Duration, data interface{}, sender ActorRefInterface) (chan struct{}, error) {
+	t := time.NewTicker(d)
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				region.Tell(EmptyContext, messageType, data, sender)
+			case <-stop:
+				t.Stop()
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+func (region *shardRegion) route(context Context) error {
+	if region.options.EntityId == nil {
+		return fmt.Errorf("entities of %v only told through their references", region.typeName)
+	}
+
+	entityId := region.options.EntityId(context)
+	if entityId == "" {
+		ErrorLogger.Printf("No entity id for message %v told to %v", context.MessageType, region.typeName)
+		return fmt.Errorf("no entity id for message %v told to %v", context.MessageType, region.typeName)
+	}
+
+	return region.routeEntity(entityId, context)
+}
+
+func (region *shardRegion) routeEntity(entityId string, context Context) error {
+	shardId := region.shardIdOf(context, entityId)
+	if region.cluster == nil {
+		return region.deliver(entityId, shardId, context)
+	}
+
+	//The messages are buffered while the home is requested, and until the ones buffered before have been routed
+	region.mutex.Lock()
+	owner, known := region.owners[shardId]
+	if known && owner != region.node && region.cluster.removed(owner) {
+		delete(region.owners, shardId)
+		known = false
+	}
+	pending, requested := region.waiting[shardId]
+	if requested || !known {
+		region.waiting[shardId] = append(pending, shardPending{entityId, context})
+		region.mutex.Unlock()
+
+		if !requested {
+			region.tellCoordinator(GosirisMsgShardGetHome, shardCoordination{Node: region.node, ShardId: shardId})
+		}
+		return nil
+	}
+	region.mutex.Unlock()
+
+	return region.routeTo(owner, entityId, shardId, context)
+}
+
+func (region *shardRegion) routeTo(owner string, entityId string, shardId string, context Context) error {
+	if owner == region.node {
+		return region.deliver(entityId, shardId, context)
+	}
+
+	return region.forward(owner, entityId, shardId, context)
+}
+
+func (region *shardRegion) shardIdOf(context Context, entityId string) string {
+	if region.options.ShardId != nil {
+		return region.options.ShardId(context)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(entityId))
+
+	return strconv.Itoa(int(h.Sum32() % uint32(region.options.NumberOfShards)))
+}
+
+func (region *shardRegion) forward(owner string, entityId string, shardId string, context Context) error {
+	return forwardShardEnvelope(shardRegionName(region.typeName, owner), entityId, shardId, context, region)
+}
+
+//The shard is empty if unknown to the sender, the region computing it
+func forwardShardEnvelope(name string, entityId string, shardId string, context Context, defaultSender ActorRefInterface) error {
+	ref, err := ActorSystem().ActorOf(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(context.Data)
+	if err != nil {
+		ErrorLogger.Printf("Failed to encode message %v for entity %v: %v", context.MessageType, entityId, err)
+		return err
+	}
+	envelope, _ := json.Marshal(shardEnvelope{entityId, shardId, context.MessageType, data})
+
+	sender := context.Sender
+	if sender == nil {
+		sender = defaultSender
+	}
+
+	return ref.Tell(context, GosirisMsgShardEnvelope, string(envelope), sender)
+}
+
+//The messages forwarded by a region whose allocation is outdated are routed again, the home of their shard being
+//requested to the coordinator if it is not this node
+func (region *shardRegion) receiveEnvelope(context Context) {
+	s, _ := context.Data.(string)
+	envelope := shardEnvelope{}
+	err := json.Unmarshal([]byte(s), &envelope)
+	if err != nil {
+		ErrorLogger.Printf("Invalid message forwarded to %v: %v", region.typeName, err)
+		return
+	}
+
+	var data interface{}
+	if len(envelope.Data) != 0 {
+		json.Unmarshal(envelope.Data, &data)
+	}
+
+	context.MessageType = envelope.MessageType
+	context.Data = data
+
+	region.mutex.Lock()
+	if region.owners[envelope.ShardId] != region.node {
+		delete(region.owners, envelope.ShardId)
+	}
+	region.mutex.Unlock()
+	region.routeEntity(envelope.EntityId, context)
+}
+
+//The messages buffered are routed in order before the home is set, the ones told meanwhile being buffered too
+func (region *shardRegion) receiveHome(context Context) {
+	coordination, ok := decodeShardCoordination(context)
+	if !ok {
+		return
+	}
+
+	region.mutex.Lock()
+	if _, requested := region.waiting[coordination.ShardId]; !requested {
+		region.mutex.Unlock()
+		return
+	}
+	region.owners[coordination.ShardId] = coordination.Node
+	for {
+		pending := region.waiting[coordination.ShardId]
+		if len(pending) == 0 {
+			delete(region.waiting, coordination.ShardId)
+			region.mutex.Unlock()
+			return
+		}
+		region.waiting[coordination.ShardId] = nil
+		region.mutex.Unlock()
+
+		for _, p := range pending {
+			region.routeTo(coordination.Node, p.entityId, coordination.ShardId, p.context)
+		}
+		region.mutex.Lock()
+	}
+}
+
+//The shard is not routed to its owner anymore, which stops its entities then confirms once none is left. The
+//entities still starting are stopped when the coordinator tells the hand-off again.
+func (region *shardRegion) receiveHandOff(context Context) {
+	coordination, ok := decodeShardCoordination(context)
+	if !ok {
+		return
+	}
+
+	region.mutex.Lock()
+	delete(region.owners, coordination.ShardId)
+	region.mutex.Unlock()
+
+	region.stop(func(e *shardEntity) bool {
+		return e.shardId == coordination.ShardId
+	})
+
+	region.registration.Lock()
+	defer region.registration.Unlock()
+
+	region.mutex.Lock()
+	for _, e := range region.entities {
+		if e.shardId == coordination.ShardId {
+			region.mutex.Unlock()
+			return
+		}
+	}
+	region.mutex.Unlock()
+
+	region.tellCoordinator(GosirisMsgShardStopped, shardCoordination{Node: region.node, ShardId: coordination.ShardId})
+}
+
+//Registers the shards hosted by this node to the coordinator
+func (region *shardRegion) register() {
+	region.registration.Lock()
+	defer region.registration.Unlock()
+
+	region.mutex.Lock()
+	var shards []string
+	for shardId, owner := range region.owners {
+		if owner == region.node {
+			shards = append(shards, shardId)
+		}
+	}
+	region.mutex.Unlock()
+
+	region.tellCoordinator(GosirisMsgShardRegister, shardCoordination{Node: region.node, Shards: shards})
+}
+
+func (region *shardRegion) lead(leader string) {
+	region.mutex.Lock()
+	region.leader = leader
+	if leader == region.node && region.coordinator == nil {
+		region.coordinator = newShardCoordinator(region)
+	} else if leader != region.node {
+		region.coordinator = nil
+	}
+	region.mutex.Unlock()
+
+	InfoLogger.Printf("Coordinator of %v: %v", region.typeName, leader)
+
+	region.register()
+	region.requestHomes()
+}
+
+//The homes are requested again in case the coordinator has changed or a message has been lost
+func (region *shardRegion) requestHomes() {
+	region.mutex.Lock()
+	var shards []string
+	for shardId := range region.waiting {
+		shards = append(shards, shardId)
+	}
+	region.mutex.Unlock()
+
+	for _, shardId := range shards {
+		region.tellCoordinator(GosirisMsgShardGetHome, shardCoordination{Node: region.node, ShardId: shardId})
+	}
+}
+
+//In a cluster, an entity is only activated while its shard is allocated to this node
+func (region *shardRegion) deliver(entityId string, shardId string, context Context) error {
+	region.mutex.Lock()
+	e, exists := region.entities[entityId]
+	if exists && (e.starting || e.stopping) {
+		e.pending = append(e.pending, context)
+		region.mutex.Unlock()
+		return nil
+	}
+	if !exists && region.cluster != nil && region.owners[shardId] != region.node {
+		region.mutex.Unlock()
+		return region.routeEntity(entityId, context)
+	}
+	if !exists {
+		e = &shardEntity{shardId: shardId, last: time.Now(), starting: true}
+		region.entities[entityId] = e
+		region.mutex.Unlock()
+
+		return region.activate(entityId, e, context)
+	}
+	e.last = time.Now()
+	ref := e.ref
+	region.mutex.Unlock()
+
+	return region.tell(ref, context)
+}
+
+//The entity is created and spawned outside of the lock, its factory possibly loading its state (e.g. a grain),
+//the messages received meanwhile being told once its first message has been
+func (region *shardRegion) activate(entityId string, e *shardEntity, context Context) error {
+	name := region.typeName + "/" + entityId
+	actor := region.options.Entity(entityId)
+	err := fmt.Errorf("entity %v not created", name)
+	if actor != nil {
+		err = ActorSystem().SpawnActor(RootActor(), name, actor, nil)
+	}
+
+	if err != nil {
+		ErrorLogger.Printf("Entity %v not activated: %v", name, err)
+
+		region.mutex.Lock()
+		delete(region.entities, entityId)
+		pending := e.pending
+		region.mutex.Unlock()
+
+		for _, context := range pending {
+			region.deliver(entityId, e.shardId, context)
+		}
+		return err
+	}
+
+	ref, _ := ActorSystem().ActorOf(name)
+	region.mutex.Lock()
+	e.actor = actor
+	e.ref = ref
+	region.mutex.Unlock()
+	InfoLogger.Printf("Entity %v activated", name)
+
+	err = region.tell(ref, context)
+	for {
+		region.mutex.Lock()
+		pending := e.pending
+		e.pending = nil
+		if len(pending) == 0 {
+			e.starting = false
+			e.last = time.Now()
+			region.mutex.Unlock()
+			return err
+		}
+		region.mutex.Unlock()
+
+		for _, context := range pending {
+			region.tell(ref, context)
+		}
+	}
+}
+
+func (region *shardRegion) tell(ref ActorRefInterface, context Context) error {
+	sender := entitySender(context.Sender)
+	if sender == nil {
+		sender = region
+	}
+
+	return ref.Tell(context, context.MessageType, context.Data, sender)
+}
+
+//An entity of another node, or deactivated since, is replied through its reference rather than its actor
+func entitySender(sender ActorRefInterface) ActorRefInterface {
+	if sender == nil {
+		return nil
+	}
+	if _, err := ActorSystem().actor(sender.Name()); err == nil {
+		return sender
+	}
+
+	i := strings.Index(sender.Name(), "/")
+	if i == -1 {
+		return sender
+	}
+	shardRegionsMutex.Lock()
+	_, exists := shardRegions[sender.Name()[:i]]
+	shardRegionsMutex.Unlock()
+	if !exists {
+		return sender
+	}
+
+	return ActorSystem().VirtualActorOf(sender.Name()[:i], sender.Name()[i+1:])
+}
+
+func (region *shardRegion) run() {
+	tick := shardRegionTick
+	if region.options.PassivationTimeout > 0 && region.options.PassivationTimeout/2 < tick {
+		tick = region.options.PassivationTimeout / 2
+	}
+
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for {
+		select {
+		case leader := <-region.leaders:
+			region.lead(leader)
+		case <-t.C:
+			region.passivate()
+			if region.cluster != nil {
+				region.register()
+				region.requestHomes()
+				region.rebalance()
+			}
+		case <-region.done:
+			return
+		}
+	}
+}
+
+func (region *shardRegion) passivate() {
+	if region.options.PassivationTimeout < 0 {
+		return
+	}
+
+	now := time.Now()
+	region.stop(func(e *shardEntity) bool {
+		return now.Sub(e.last) > region.options.PassivationTimeout
+	})
+}
+
+//Forgets the homes on the nodes not members anymore, then rebalances the shards if this node is the coordinator
+func (region *shardRegion) rebalance() {
+	select {
+	case <-region.done:
+		return
+	default:
+	}
+
+	members := make(map[string]bool)
+	for _, m := range region.cluster.Members() {
+		members[m.Id] = true
+	}
+
+	region.mutex.Lock()
+	for shardId, owner := range region.owners {
+		if !members[owner] {
+			delete(region.owners, shardId)
+		}
+	}
+	coordinator := region.coordinator
+	region.mutex.Unlock()
+
+	if coordinator != nil {
+		coordinator.rebalance()
+	}
+}
+
+//The entities are closed outside of the lock, their reactions possibly telling the region
+func (region *shardRegion) stop(f func(*shardEntity) bool) {
+	region.mutex.Lock()
+	var ids []string
+	for id, e := range region.entities {
+		if !e.starting && !e.stopping && f(e) {
+			e.stopping = true
+			ids = append(ids, id)
+		}
+	}
+	region.mutex.Unlock()
+
+	for _, id := range ids {
+		region.mutex.Lock()
+		e := region.entities[id]
+		region.mutex.Unlock()
+
+		e.actor.Close()
+
+		region.mutex.Lock()
+		delete(region.entities, id)
+		pending := e.pending
+		region.mutex.Unlock()
+
+		InfoLogger.Printf("Entity %v/%v stopped", region.typeName, id)
+
+		//The messages are dropped once the region is closed
+		select {
+		case <-region.done:
+			continue
+		default:
+		}
+		for _, context := range pending {
+			region.routeEntity(id, context)
+		}
+	}
+}
+
+func (region *shardRegion) close() {
+	select {
+	case <-region.done:
+		return
+	default:
+		close(region.done)
+	}
+
+	region.stop(func(e *shardEntity) bool {
+		return true
+	})
+
+	//The coordinator is handed over to the next candidate
+	if region.stopElection != nil {
+		region.stopElection()
+	}
+	if region.regionActor != nil {
+		region.cluster.SetMetadata(shardRegionMetadata+region.typeName, "")
+		region.regionActor.Close()
+	}
+
+	InfoLogger.Printf("Sharding of %v stopped", region.typeName)
+}
@@ -0,0 +1,280 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+)
+
+const shardCoordinatorElection = "gosiris.shardCoordinator." //Election of the coordinator of a type of entities
+
+//Message exchanged between the regions of a type of entities and their coordinator, JSON encoded
+type shardCoordination struct {
+	Node    string   `json:"node"` //Node of the sender, or of the home of the shard
+	ShardId string   `json:"shardId,omitempty"`
+	Shards  []string `json:"shards,omitempty"` //Shards hosted by the region registering
+}
+
+//Message told by the coordinator once its lock released
+type shardCoordinationMessage struct {
+	node         string
+	messageType  string
+	coordination shardCoordination
+}
+
+//The coordinator of a type of entities runs in the region of the node elected through the registry, and is the only
+//one allocating the shards. A shard is allocated by rendezvous hashing among the regions registered and up, so that
+//only the shards of a node joining or leaving are moved. A shard is handed off in two steps: every region stops
+//routing it to its owner, which stops its entities, then the shard is allocated again once the owner has confirmed.
+//A new coordinator rebuilds the allocations from the shards hosted by the regions, allocating none before every
+//region discovered has registered.
+type shardCoordinator struct {
+	region      *shardRegion
+	registered  map[string]bool     //Nodes whose region has registered since the election
+	allocations map[string]string   //Node of each shard allocated
+	handoffs    map[string]bool     //Shards handed off, waiting for their owner to confirm
+	requests    map[string][]string //Nodes waiting for the home of a shard
+	mutex       sync.Mutex
+}
+
+func newShardCoordinator(region *shardRegion) *shardCoordinator {
+	return &shardCoordinator{
+		region:      region,
+		registered:  make(map[string]bool),
+		allocations: make(map[string]string),
+		handoffs:    make(map[string]bool),
+		requests:    make(map[string][]string),
+	}
+}
+
+//Allocates a shard to the node with the highest hash of the shard and node ids, none if there is no node
+func allocateShard(shardId string, nodes []string) string {
+	owner, highest := "", uint64(0)
+	for _, node := range nodes {
+		if score := shardScore(shardId, node); owner == "" || score > highest || (score == highest && node < owner) {
+			owner, highest = node, score
+		}
+	}
+
+	return owner
+}
+
+func shardScore(shardId string, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(shardId + "/" + node))
+
+	return h.Sum64()
+}
+
+//Returns the nodes whose region has been discovered, and the ones among them up (sorted by id)
+func (coordinator *shardCoordinator) regions() (map[string]bool, []string) {
+	discovered := make(map[string]bool)
+	var up []string
+	for _, m := range coordinator.region.cluster.Members() {
+		name := m.Metadata[shardRegionMetadata+coordinator.region.typeName]
+		if name == "" {
+			continue
+		}
+		if _, err := ActorSystem().ActorOf(name); err != nil {
+			continue
+		}
+
+		discovered[m.Id] = true
+		if m.Status == MemberStatusUp {
+			up = append(up, m.Id)
+		}
+	}
+
+	return discovered, up
+}
+
+//A shard registered by another region than its owner (e.g. hosted by both before the election) is handed off by that region
+func (coordinator *shardCoordinator) register(node string, shards []string) {
+	coordinator.mutex.Lock()
+	first := !coordinator.registered[node]
+	coordinator.registered[node] = true
+
+	var messages []shardCoordinationMessage
+	for _, shardId := range shards {
+		owner, exists := coordinator.allocations[shardId]
+		if !exists {
+			coordinator.allocations[shardId] = node
+		} else if owner != node {
+			messages = append(messages, shardCoordinationMessage{node, GosirisMsgShardHandOff, shardCoordination{Node: coordinator.region.node, ShardId: shardId}})
+		}
+	}
+	coordinator.mutex.Unlock()
+
+	coordinator.region.tellRegions(messages)
+
+	if first {
+		coordinator.rebalance()
+	}
+}
+
+func (coordinator *shardCoordinator) getHome(node string, shardId string) {
+	coordinator.mutex.Lock()
+	coordinator.requests[shardId] = append(coordinator.requests[shardId], node)
+	coordinator.mutex.Unlock()
+
+	coordinator.answer()
+}
+
+//The confirmations of the other regions than the owner are ignored
+func (coordinator *shardCoordinator) stopped(node string, shardId string) {
+	coordinator.mutex.Lock()
+	if coordinator.allocations[shardId] == node {
+		delete(coordinator.allocations, shardId)
+		delete(coordinator.handoffs, shardId)
+	}
+	coordinator.mutex.Unlock()
+
+	coordinator.answer()
+}
+
+//Answers the requests once every region discovered has registered, except for the shards handed off. The shards of
+//the regions not discovered anymore (e.g. removed members) are allocated again.
+func (coordinator *shardCoordinator) answer() {
+	discovered, up := coordinator.regions()
+
+	coordinator.mutex.Lock()
+	for node := range discovered {
+		if !coordinator.registered[node] {
+			coordinator.mutex.Unlock()
+			return
+		}
+	}
+
+	var candidates []string
+	for _, node := range up {
+		if coordinator.registered[node] {
+			candidates = append(candidates, node)
+		}
+	}
+
+	var messages []shardCoordinationMessage
+	for shardId, nodes := range coordinator.requests {
+		if coordinator.handoffs[shardId] {
+			continue
+		}
+
+		home, exists := coordinator.allocations[shardId]
+		if !exists || !discovered[home] {
+			home = allocateShard(shardId, candidates)
+			if home == "" {
+				continue
+			}
+			coordinator.allocations[shardId] = home
+		}
+
+		for _, node := range nodes {
+			messages = append(messages, shardCoordinationMessage{node, GosirisMsgShardHome, shardCoordination{Node: home, ShardId: shardId}})
+		}
+		delete(coordinator.requests, shardId)
+	}
+	coordinator.mutex.Unlock()
+
+	coordinator.region.tellRegions(messages)
+}
+
+//Hands off the shards not allocated to the node they would be allocated to now, the hand-offs pending being told
+//again in case a message has been lost. The shards of the regions not discovered anymore are released.
+func (coordinator *shardCoordinator) rebalance() {
+	discovered, up := coordinator.regions()
+
+	coordinator.mutex.Lock()
+	var candidates []string
+	for _, node := range up {
+		if coordinator.registered[node] {
+			candidates = append(candidates, node)
+		}
+	}
+
+	var handoffs []string
+	for shardId, owner := range coordinator.allocations {
+		if !discovered[owner] {
+			delete(coordinator.allocations, shardId)
+			delete(coordinator.handoffs, shardId)
+			continue
+		}
+
+		if target := allocateShard(shardId, candidates); coordinator.handoffs[shardId] || (target != "" && target != owner) {
+			coordinator.handoffs[shardId] = true
+			handoffs = append(handoffs, shardId)
+		}
+	}
+	coordinator.mutex.Unlock()
+
+	var messages []shardCoordinationMessage
+	for node := range discovered {
+		for _, shardId := range handoffs {
+			messages = append(messages, shardCoordinationMessage{node, GosirisMsgShardHandOff, shardCoordination{Node: coordinator.region.node, ShardId: shardId}})
+		}
+	}
+	coordinator.region.tellRegions(messages)
+
+	coordinator.answer()
+}
+
+//The messages are told to the region actors, the ones of the regions not discovered being dropped
+func (region *shardRegion) tellRegions(messages []shardCoordinationMessage) {
+	for _, m := range messages {
+		region.tellRegion(m.node, m.messageType, m.coordination)
+	}
+}
+
+func (region *shardRegion) tellRegion(node string, messageType string, coordination shardCoordination) {
+	ref, err := ActorSystem().ActorOf(shardRegionName(region.typeName, node))
+	if err != nil {
+		return
+	}
+
+	data, _ := json.Marshal(coordination)
+	err = ref.Tell(EmptyContext, messageType, string(data), region)
+	if err != nil {
+		ErrorLogger.Printf("Failed to tell %v to the region of %v on %v: %v", messageType, region.typeName, node, err)
+	}
+}
+
+//Messages told to the coordinator, dropped while there is no coordinator elected
+func (region *shardRegion) tellCoordinator(messageType string, coordination shardCoordination) {
+	region.mutex.Lock()
+	leader := region.leader
+	region.mutex.Unlock()
+
+	if leader != "" {
+		region.tellRegion(leader, messageType, coordination)
+	}
+}
+
+func decodeShardCoordination(context Context) (shardCoordination, bool) {
+	s, _ := context.Data.(string)
+	coordination := shardCoordination{}
+	err := json.Unmarshal([]byte(s), &coordination)
+	if err != nil {
+		ErrorLogger.Printf("Invalid message %v: %v", context.MessageType, err)
+		return coordination, false
+	}
+
+	return coordination, true
+}
+
+//Messages received by the coordinator, ignored if this node is not the coordinator anymore
+func (region *shardRegion) receiveCoordination(context Context) {
+	coordination, ok := decodeShardCoordination(context)
+	region.mutex.Lock()
+	coordinator := region.coordinator
+	region.mutex.Unlock()
+	if !ok || coordinator == nil {
+		return
+	}
+
+	switch context.MessageType {
+	case GosirisMsgShardRegister:
+		coordinator.register(coordination.Node, coordination.Shards)
+	case GosirisMsgShardGetHome:
+		coordinator.getHome(coordination.Node, coordination.ShardId)
+	case GosirisMsgShardStopped:
+		coordinator.stopped(coordination.Node, coordination.ShardId)
+	}
+}
@@ -0,0 +1,271 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Accounts replying with their node and the number of deposits they have received since activated
+func accountSharding(node string, replies chan string) ShardingOptions {
+	return ShardingOptions{
+		EntityId: func(context Context) string {
+			return strings.Split(fmt.Sprint(context.Data), ":")[0]
+		},
+		Entity: func(id string) *Actor {
+			deposits := 0
+			return new(Actor).React("deposit", func(context Context) {
+				deposits++
+				replies <- fmt.Sprintf("%v:%v:%v", id, node, deposits)
+			})
+		},
+		PassivationTimeout: 300 * time.Millisecond,
+	}
+}
+
+//Waits for the next reply told by the actors of a test to its channel
+func receiveReply(t *testing.T, replies chan string) string {
+	select {
+	case reply := <-replies:
+		return reply
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reply not received")
+	}
+
+	return ""
+}
+
+func expectReply(t *testing.T, replies chan string, expected string) {
+	if reply := receiveReply(t, replies); reply != expected {
+		t.Errorf("Unexpected reply %v instead of %v", reply, expected)
+	}
+}
+
+func TestShardingPassivation(t *testing.T) {
+	t.Log("Starting sharding passivation test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "ActorSystem",
+	})
+	defer CloseActorSystem()
+
+	replies := make(chan string, 10)
+	region, err := StartSharding("passivatedAccount", accountSharding("local", replies))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StartSharding("passivatedAccount", accountSharding("local", replies)); err == nil {
+		t.Errorf("Sharding started twice")
+	}
+
+	region.Tell(EmptyContext, "deposit", "42", region)
+	expectReply(t, replies, "42:local:1")
+	region.Tell(EmptyContext, "deposit", "42", region)
+	expectReply(t, replies, "42:local:2")
+	if _, err := ActorSystem().ActorOf("passivatedAccount/42"); err != nil {
+		t.Errorf("Entity not spawned: %v", err)
+	}
+
+	//The entity is passivated once idle, then activated again by the next message
+	time.Sleep(time.Second)
+	if _, err := ActorSystem().ActorOf("passivatedAccount/42"); err == nil {
+		t.Errorf("Entity not passivated")
+	}
+	region.Tell(EmptyContext, "deposit", "42", region)
+	expectReply(t, replies, "42:local:1")
+
+	if err := region.Tell(EmptyContext, "deposit", "", region); err == nil {
+		t.Errorf("Message without entity id routed")
+	}
+}
+
+func TestShardingRebalance(t *testing.T) {
+	t.Log("Starting sharding rebalance test")
+
+	err := InitActorSystem(SystemOptions{
+		ActorSystemName: "ShardingSystem",
+		RegistryUrl:     "mem://TestShardingRebalance",
+		NodeId:          "shardNodeA",
+		ClusterOptions:  clusterTestOptions(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseActorSystem()
+
+	replies := make(chan string, 100)
+	optionsA := accountSharding("A", replies)
+	optionsA.Remote = new(ActorOptions).SetRemoteType(Memory).SetUrl("TestShardingRebalance")
+	optionsA.PassivationTimeout = -1
+	region, err := StartSharding("account", optionsA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The entities are all activated on node A while it is alone
+	for i := 0; i < 20; i++ {
+		region.Tell(EmptyContext, "deposit", fmt.Sprint(i), region)
+		expectReply(t, replies, fmt.Sprintf("%v:A:1", i))
+	}
+
+	//Another node running the same region joins
+	nodeB := newClusterTestNode(t, "shardNodeB", Cluster().Self().Address)
+	defer nodeB.stop()
+	registryB, _ := newRegistry("mem://TestShardingRebalance", registryNamespace{namespace: "ShardingSystem"})
+	defer registryB.Close()
+	optionsB := accountSharding("B", replies)
+	optionsB.Remote = new(ActorOptions).SetRemoteType(Memory).SetUrl("TestShardingRebalance")
+	optionsB.PassivationTimeout = -1
+	regionB, err := newShardRegion("account", optionsB, nodeB, registryB.(registryElection), "shardNodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regionB.close()
+
+	//Node A, the first candidate, coordinates the shards once both regions are registered
+	regionA := region.(*shardRegion)
+	for i := 0; ; i++ {
+		regionA.mutex.Lock()
+		coordinator := regionA.coordinator
+		regionA.mutex.Unlock()
+
+		registered := 0
+		if coordinator != nil {
+			coordinator.mutex.Lock()
+			registered = len(coordinator.registered)
+			coordinator.mutex.Unlock()
+		}
+		if registered == 2 {
+			break
+		}
+		if i == 300 {
+			t.Fatal("Regions not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nodes := make(map[string]string)
+	deposits := make(map[string]int)
+	owned := 0
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprint(i)
+		nodes[id] = "A"
+		deposits[id] = 1
+		if allocateShard(regionA.shardIdOf(Context{Data: id}, id), []string{"shardNodeA", "shardNodeB"}) == "shardNodeB" {
+			nodes[id] = "B"
+			deposits[id] = 0
+		} else {
+			owned++
+		}
+	}
+	if owned == 0 || owned == len(nodes) {
+		t.Fatalf("Entities not spread over the nodes: %v", nodes)
+	}
+
+	//The entities of the shards allocated to node B are handed over
+	for i := 0; ; i++ {
+		regionA.mutex.Lock()
+		n := len(regionA.entities)
+		regionA.mutex.Unlock()
+		if n == owned {
+			break
+		}
+		if i == 300 {
+			t.Fatalf("Shards not handed over: %v entities instead of %v", n, owned)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//The entities are reached whatever the region they are told through
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprint(i)
+		if i%2 == 0 {
+			region.Tell(EmptyContext, "deposit", id, region)
+		} else {
+			regionB.Tell(EmptyContext, "deposit", id, regionB)
+		}
+		deposits[id]++
+		expectReply(t, replies, fmt.Sprintf("%v:%v:%v", id, nodes[id], deposits[id]))
+	}
+
+	//A message forwarded to a region not owning the shard is routed to the owner rather than activating the entity
+	for id, node := range nodes {
+		if node != "A" {
+			continue
+		}
+		refB, _ := ActorSystem().ActorOf(shardRegionName("account", "shardNodeB"))
+		envelope, _ := json.Marshal(shardEnvelope{id, regionA.shardIdOf(Context{Data: id}, id), "deposit", json.RawMessage(`"` + id + `"`)})
+		refB.Tell(EmptyContext, GosirisMsgShardEnvelope, string(envelope), regionA)
+		deposits[id]++
+		expectReply(t, replies, fmt.Sprintf("%v:A:%v", id, deposits[id]))
+		break
+	}
+
+	//Node B crashes: its shards are allocated to node A again
+	regionB.close()
+	nodeB.stop()
+	for i := 0; ; i++ {
+		if len(Cluster().Members()) == 1 {
+			break
+		}
+		if i == 200 {
+			t.Fatal("Node B not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for id, node := range nodes {
+		region.Tell(EmptyContext, "deposit", id, region)
+		if node == "B" {
+			deposits[id] = 0
+		}
+		deposits[id]++
+		expectReply(t, replies, fmt.Sprintf("%v:A:%v", id, deposits[id]))
+	}
+}
+
+func TestShardingActivation(t *testing.T) {
+	t.Log("Starting sharding activation test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "ActorSystem",
+	})
+	defer CloseActorSystem()
+
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	replies := make(chan string, 10)
+	region, err := StartSharding("slowAccount", ShardingOptions{
+		EntityId: func(context Context) string {
+			return strings.Split(fmt.Sprint(context.Data), ":")[0]
+		},
+		Entity: func(id string) *Actor {
+			//The slow entity loads its state
+			if id == "slow" {
+				close(creating)
+				<-release
+			}
+			return new(Actor).React("deposit", func(context Context) {
+				replies <- fmt.Sprint(context.Data)
+			})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go region.Tell(EmptyContext, "deposit", "slow:1", region)
+	<-creating
+	region.Tell(EmptyContext, "deposit", "slow:2", region)
+
+	//The other entities are activated meanwhile
+	region.Tell(EmptyContext, "deposit", "fast:1", region)
+	expectReply(t, replies, "fast:1")
+
+	//The messages of the slow entity are told in order once created
+	close(release)
+	expectReply(t, replies, "slow:1")
+	expectReply(t, replies, "slow:2")
+}
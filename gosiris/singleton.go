@@ -0,0 +1,277 @@
+package gosiris
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSingletonBufferSize = 1000
+	singletonRetry             = 50 * time.Millisecond
+)
+
+var singletons = make(map[string]*singletonManager)
+var singletonsMutex sync.Mutex
+
+type SingletonOptions struct {
+	Actor      func() *Actor    //Creates the singleton on the leader, nil on the nodes only telling it
+	Remote     OptionsInterface //Transport the singleton is reached through by the other nodes, its destination being set by gosiris
+	BufferSize int              //Messages buffered by the proxy while the singleton is not reachable (default: 1000)
+}
+
+//The manager of a singleton campaigns for its node in an election of the registry and spawns the singleton once
+//elected, registered under its name. It is stopped when the node resigns (e.g. the actor system is closed) before
+//the leadership is handed over to the next candidate. The manager is also a proxy telling the singleton wherever it
+//runs, the messages being buffered while there is no leader or the singleton of the leader is not discovered yet.
+//With a broker transport, the messages sent by the other nodes during the handover wait in the destination of the singleton.
+type singletonManager struct {
+	ActorRef
+	name         string
+	node         string
+	options      SingletonOptions
+	leader       string
+	actor        *Actor
+	buffer       []Context
+	flushing     bool
+	closed       bool
+	stopElection func()
+	leaders      chan string
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+//Starts the singleton of a name on this node, returning its proxy. The registry of the actor system must support the elections (etcd or in-process).
+func StartSingleton(name string, options SingletonOptions) (ActorRefInterface, error) {
+	singletonsMutex.Lock()
+	defer singletonsMutex.Unlock()
+
+	if _, exists := singletons[name]; exists {
+		return nil, fmt.Errorf("singleton %v already started", name)
+	}
+
+	election, ok := registry.(registryElection)
+	if !ok {
+		return nil, fmt.Errorf("singleton %v requires a registry supporting the elections", name)
+	}
+
+	manager, err := newSingletonManager(name, options, election, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	singletons[name] = manager
+
+	return manager, nil
+}
+
+func closeSingletons() {
+	singletonsMutex.Lock()
+	defer singletonsMutex.Unlock()
+
+	for name, manager := range singletons {
+		manager.close()
+		delete(singletons, name)
+	}
+}
+
+func newSingletonManager(name string, options SingletonOptions, election registryElection, node string) (*singletonManager, error) {
+	if options.BufferSize == 0 {
+		options.BufferSize = defaultSingletonBufferSize
+	}
+
+	manager := &singletonManager{
+		ActorRef: newActorRef(name).(ActorRef),
+		name:     name,
+		node:     node,
+		options:  options,
+		leaders:  make(chan string),
+		done:     make(chan struct{}),
+	}
+
+	candidate := ""
+	if options.Actor != nil {
+		candidate = node
+	}
+	stop, err := election.elect(name, candidate, manager.leaders)
+	if err != nil {
+		return nil, err
+	}
+	manager.stopElection = stop
+
+	go manager.run()
+
+	return manager, nil
+}
+
+func (manager *singletonManager) run() {
+	t := time.NewTicker(singletonRetry)
+	defer t.Stop()
+
+	for {
+		select {
+		case leader := <-manager.leaders:
+			manager.lead(leader)
+			manager.flush()
+		case <-t.C:
+			manager.flush()
+		case <-manager.done:
+			return
+		}
+	}
+}
+
+func (manager *singletonManager) lead(leader string) {
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return
+	}
+
+	InfoLogger.Printf("Leader of singleton %v: %v", manager.name, leader)
+	manager.leader = leader
+
+	if leader == manager.node && manager.actor == nil {
+		actor := manager.options.Actor()
+		var options OptionsInterface
+		if manager.options.Remote != nil {
+			options = manager.options.Remote.SetRemote(true).SetDestination(manager.name)
+		}
+
+		err := ActorSystem().RegisterActor(manager.name, actor, options)
+		if err != nil {
+			ErrorLogger.Printf("Failed to spawn singleton %v: %v", manager.name, err)
+		} else {
+			manager.actor = actor
+			InfoLogger.Printf("Singleton %v spawned", manager.name)
+		}
+	}
+
+	var previous *Actor
+	if leader != manager.node && manager.actor != nil {
+		previous = manager.actor
+		manager.actor = nil
+	}
+	manager.mutex.Unlock()
+
+	//Closed outside of the lock, the singleton possibly telling its proxy
+	if previous != nil {
+		previous.Close()
+		InfoLogger.Printf("Singleton %v stopped", manager.name)
+	}
+}
+
+//The singleton is reached once the actor of its name is hosted, or has been discovered on the leader
+func (manager *singletonManager) target() (ActorRefInterface, bool) {
+	if manager.leader == "" {
+		return nil, false
+	}
+
+	a, err := ActorSystem().actor(manager.name)
+	if err != nil || (!a.hosted() && a.options.Node() != manager.leader) {
+		return nil, false
+	}
+
+	return a.actorRef, true
+}
+
+func (manager *singletonManager) Tell(context Context, messageType string, data interface{}, sender ActorRefInterface) error {
+	if sender == nil {
+		sender = manager
+	}
+	context.MessageType = messageType
+	context.Data = data
+	context.Sender = sender
+
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return fmt.Errorf("singleton %v closed", manager.name)
+	}
+
+	//The messages are buffered while older ones are pending, to keep their order
+	if len(manager.buffer) == 0 && !manager.flushing {
+		if ref, ok := manager.target(); ok {
+			manager.mutex.Unlock()
+			return ref.Tell(context, messageType, data, sender)
+		}
+	}
+
+	if len(manager.buffer) >= manager.options.BufferSize {
+		manager.mutex.Unlock()
+		ErrorLogger.Printf("Message %v to singleton %v dropped, buffer full", messageType, manager.name)
+		return fmt.Errorf("singleton %v buffer full", manager.name)
+	}
+	manager.buffer = append(manager.buffer, context)
+	manager.mutex.Unlock()
+
+	return nil
+}
+
+func (manager *singletonManager) Repeat(messageType string, d time.Duration, data interface{}, sender ActorRefInterface) (chan struct{}, error) {
+	t := time.NewTicker(d)
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				manager.Tell(EmptyContext, messageType, data, sender)
+			case <-stop:
+				t.Stop()
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	return stop, nil
+}
+
+func (manager *singletonManager) flush() {
+	manager.mutex.Lock()
+	if manager.flushing {
+		manager.mutex.Unlock()
+		return
+	}
+
+	for len(manager.buffer) != 0 && !manager.closed {
+		ref, ok := manager.target()
+		if !ok {
+			break
+		}
+
+		pending := manager.buffer
+		manager.buffer = nil
+		manager.flushing = true
+		manager.mutex.Unlock()
+
+		for _, context := range pending {
+			ref.Tell(context, context.MessageType, context.Data, context.Sender)
+		}
+
+		manager.mutex.Lock()
+	}
+	manager.flushing = false
+	manager.mutex.Unlock()
+}
+
+//Stops the singleton if running on this node, then resigns so that the next candidate takes over
+func (manager *singletonManager) close() {
+	manager.mutex.Lock()
+	if manager.closed {
+		manager.mutex.Unlock()
+		return
+	}
+	manager.closed = true
+	actor := manager.actor
+	manager.actor = nil
+	manager.mutex.Unlock()
+
+	if actor != nil {
+		actor.Close()
+		InfoLogger.Printf("Singleton %v stopped", manager.name)
+	}
+
+	manager.stopElection()
+	close(manager.done)
+}
@@ -0,0 +1,81 @@
+package gosiris
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//Schedulers replying with their node and the job received
+func scheduler(node string, received chan string) SingletonOptions {
+	return SingletonOptions{
+		Actor: func() *Actor {
+			return new(Actor).React("job", func(context Context) {
+				received <- fmt.Sprintf("%v:%v", node, context.Data)
+			})
+		},
+	}
+}
+
+func TestSingleton(t *testing.T) {
+	t.Log("Starting singleton test")
+
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "SingletonSystem",
+		RegistryUrl:     "mem://TestSingleton",
+		NodeId:          "singletonNodeA",
+	})
+	defer CloseActorSystem()
+
+	received := make(chan string, 10)
+	proxyA, err := StartSingleton("scheduler", scheduler("A", received))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Node B is another candidate, node C only tells the singleton
+	registryB, _ := newRegistry("mem://TestSingleton", registryNamespace{namespace: "SingletonSystem"})
+	defer registryB.Close()
+	managerB, err := newSingletonManager("scheduler", scheduler("B", received), registryB.(registryElection), "singletonNodeB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer managerB.close()
+	registryC, _ := newRegistry("mem://TestSingleton", registryNamespace{namespace: "SingletonSystem"})
+	defer registryC.Close()
+	proxyC, err := newSingletonManager("scheduler", SingletonOptions{}, registryC.(registryElection), "singletonNodeC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyC.close()
+
+	//Node A, the first candidate, runs the singleton
+	proxyC.Tell(EmptyContext, "job", 1, proxyC)
+	expectReply(t, received, "A:1")
+	proxyA.Tell(EmptyContext, "job", 2, proxyA)
+	expectReply(t, received, "A:2")
+
+	//Node A leaves: the messages told during the handover are buffered then received by the singleton of node B
+	proxyA.(*singletonManager).close()
+	for i := 3; i < 6; i++ {
+		proxyC.Tell(EmptyContext, "job", i, proxyC)
+	}
+	for i := 3; i < 6; i++ {
+		expectReply(t, received, fmt.Sprintf("B:%v", i))
+	}
+
+	if err := proxyA.Tell(EmptyContext, "job", 6, proxyA); err == nil {
+		t.Errorf("Message told to a closed proxy")
+	}
+
+	//Without any candidate left, the messages are buffered up to the buffer size
+	managerB.close()
+	small, _ := newSingletonManager("scheduler", SingletonOptions{BufferSize: 2}, registryC.(registryElection), "singletonNodeD")
+	defer small.close()
+	time.Sleep(50 * time.Millisecond)
+	small.Tell(EmptyContext, "job", 7, small)
+	small.Tell(EmptyContext, "job", 8, small)
+	if err := small.Tell(EmptyContext, "job", 9, small); err == nil {
+		t.Errorf("Message buffered beyond the buffer size")
+	}
+}
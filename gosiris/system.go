@@ -3,6 +3,9 @@ package gosiris
 import (
 	"fmt"
 	"github.com/opentracing/opentracing-go"
+	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -10,11 +13,16 @@ var root *Actor
 var actorSystemInstance actorSystem
 var actorSystemStarted bool
 var registry registryInterface
+var nodeId string
 
 type SystemOptions struct {
-	ActorSystemName string
-	ZipkinOptions   ZipkinOptions
-	RegistryUrl     string
+	ActorSystemName       string
+	ZipkinOptions         ZipkinOptions
+	RegistryUrl           string
+	RegistryNamespace     string //Namespace of the actors in the registry, only the actors of the same namespace being discovered (default: ActorSystemName)
+	RegistryAllNamespaces bool   //Discovers the actors of the other namespaces too, named namespace/actor
+	NodeId                string //Identifier of the actor system published with its actors (default: hostname-pid)
+	ClusterOptions        ClusterOptions
 }
 
 func init() {
@@ -31,10 +39,33 @@ func InitActorSystem(options SystemOptions) error {
 
 	actorSystemInstance = actorSystem{}
 	actorSystemInstance.actors = make(map[string]actorAssociation)
+	actorSystemInstance.discovered = make(map[string]OptionsInterface)
 	actorSystemStarted = true
 
+	nodeId = options.NodeId
+	if nodeId == "" {
+		hostname, _ := os.Hostname()
+		nodeId = fmt.Sprintf("%v-%v", hostname, os.Getpid())
+	}
+
+	//The cluster is joined first so that the actors of the nodes already removed are not discovered
+	if options.ClusterOptions.Address != "" {
+		c, err := newCluster(options.ClusterOptions, nodeId)
+		if err != nil {
+			actorSystemStarted = false
+			ErrorLogger.Printf("Failed to join the cluster: %v", err)
+			return err
+		}
+		c.subscribe(ActorSystem().onClusterEvent)
+		clusterInstance = c
+	}
+
 	if options.RegistryUrl != "" {
-		initDistributedActorSystem(options.RegistryUrl)
+		namespace := options.RegistryNamespace
+		if namespace == "" {
+			namespace = options.ActorSystemName
+		}
+		initDistributedActorSystem(options.RegistryUrl, registryNamespace{namespace, options.RegistryAllNamespaces})
 	}
 
 	if options.ZipkinOptions.Url != "" {
@@ -44,10 +75,9 @@ func InitActorSystem(options SystemOptions) error {
 	return nil
 }
 
-func initDistributedActorSystem(url string) error {
-	//TODO Manage the implementation dynamically
-	registry = &etcdClient{}
-	err := registry.Configure(url)
+func initDistributedActorSystem(url string, namespace registryNamespace) error {
+	var err error
+	registry, err = newRegistry(url, namespace)
 	if err != nil {
 		actorSystemStarted = false
 		FatalLogger.Fatalf("Failed to configure access to the remote repository: %v", err)
@@ -62,6 +92,8 @@ func initDistributedActorSystem(url string) error {
 	InitRemoteConnections(conf)
 	ActorSystem().addRemoteActors(conf)
 
+	go registry.Watch(ActorSystem().onActorCreatedFromRegistry, ActorSystem().onActorRemovedFromRegistry)
+
 	return nil
 }
 
@@ -75,8 +107,16 @@ func CloseActorSystem() error {
 		return fmt.Errorf("actor system not started")
 	}
 
+	closeMediator()
+	closeSingletons()
+	closeShardRegions()
 	if registry != nil {
 		registry.Close()
+		registry = nil
+	}
+	if clusterInstance != nil {
+		clusterInstance.Leave()
+		clusterInstance = nil
 	}
 	InfoLogger.Printf("Actor system closed")
 
@@ -92,8 +132,15 @@ type actorAssociation struct {
 	options  OptionsInterface
 }
 
+//An actor is hosted by this system if it reacts to messages, as opposed to the references to remote actors
+func (association actorAssociation) hosted() bool {
+	return association.actor != nil && association.actor.reactions() != nil
+}
+
 type actorSystem struct {
-	actors map[string]actorAssociation
+	actors     map[string]actorAssociation
+	discovered map[string]OptionsInterface //Registry entries as last notified by the watch
+	mutex      sync.RWMutex
 }
 
 func (system *actorSystem) RegisterActor(name string, actor actorInterface, options OptionsInterface) error {
@@ -109,8 +156,8 @@ func (system *actorSystem) RegisterActor(name string, actor actorInterface, opti
 func (system *actorSystem) SpawnActor(parent actorInterface, name string, actor actorInterface, options OptionsInterface) error {
 	InfoLogger.Printf("Spawning new actor %v", name)
 
-	_, exists := system.actors[name]
-	if exists {
+	_, err := system.actor(name)
+	if err == nil {
 		InfoLogger.Printf("Actor %v already registered", name)
 	}
 
@@ -130,15 +177,15 @@ func (system *actorSystem) SpawnActor(parent actorInterface, name string, actor
 		actor.setDataChan(make(chan Context, options.BufferSize()))
 		actor.setCloseChan(make(chan interface{}))
 	} else {
-		registry.RegisterActor(name, options)
-		go registry.Watch(system.onActorCreatedFromRegistry, system.onActorRemovedFromRegistry)
+		if registry != nil {
+			registry.RegisterActor(name, options)
+		}
 		AddConnection(name, options)
 	}
 
 	actorRef := newActorRef(name)
 
-	system.actors[name] =
-		actorAssociation{actorRef, actor, options}
+	system.setActor(name, actorAssociation{actorRef, actor, options})
 
 	go receive(actor, options)
 
@@ -152,6 +199,8 @@ func (system *actorSystem) SpawnActor(parent actorInterface, name string, actor
 					p, err := system.actor(parent.Name())
 					if err != nil {
 						ErrorLogger.Printf("Parent of actor %v not found", name)
+						t.Stop()
+						return
 					}
 					dispatch(p.actor.getDataChan(), GosirisMsgHeartbeatRequest, nil, actorRef, p.actorRef, new(ActorOptions), nil)
 				}
@@ -163,24 +212,120 @@ func (system *actorSystem) SpawnActor(parent actorInterface, name string, actor
 }
 
 func (system *actorSystem) onActorCreatedFromRegistry(name string, options *ActorOptions) {
+	system.mutex.Lock()
+	system.discovered[name] = options
+	system.mutex.Unlock()
+
+	system.addDiscoveredActor(name, options)
+}
+
+func (system *actorSystem) addDiscoveredActor(name string, options *ActorOptions) {
+	if clusterInstance != nil && clusterInstance.removed(options.Node()) {
+		InfoLogger.Printf("Actor %v of removed node %v ignored", name, options.Node())
+		return
+	}
+
+	a, err := system.actor(name)
+	if err == nil {
+		if a.hosted() {
+			return
+		}
+
+		//The connection is kept if only the labels of the actor have been updated
+		if sameConnection(a.options, options) {
+			a.options = options
+			system.setActor(name, a)
+			InfoLogger.Printf("Actor %v updated", name)
+			return
+		}
+
+		//The entry of the actor has been updated
+		DeleteRemoteActorConnection(name)
+	}
+
 	actorRef := newActorRef(name)
 	actor := Actor{}
 	actor.name = name
 
-	system.actors[name] =
-		actorAssociation{actorRef, nil, options}
+	system.setActor(name, actorAssociation{actorRef, &actor, options})
 
 	AddConnection(name, options)
 
 	InfoLogger.Printf("Actor %v added to the local system", name)
 }
 
+func sameConnection(a OptionsInterface, b OptionsInterface) bool {
+	if a.RemoteType() != b.RemoteType() || a.Url() != b.Url() || a.Destination() != b.Destination() || len(a.TransportOptions()) != len(b.TransportOptions()) {
+		return false
+	}
+
+	for k, v := range a.TransportOptions() {
+		if w, exists := b.TransportOptions()[k]; !exists || v != w {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (system *actorSystem) onActorRemovedFromRegistry(name string) {
+	system.mutex.Lock()
+	delete(system.discovered, name)
+	system.mutex.Unlock()
+
+	if a, err := system.actor(name); err == nil && a.hosted() {
+		return
+	}
+
 	system.removeRemoteActor(name)
 
 	InfoLogger.Printf("Actor %v removed from the local system", name)
 }
 
+//The actors discovered through the registry are removed with their node, without waiting for their entries to expire,
+//then resolved again from the registry entries notified meanwhile once the node rejoins
+func (system *actorSystem) onClusterEvent(messageType string, member Member) {
+	if messageType == GosirisMsgMemberUp {
+		system.resolveNodeActors(member.Id)
+		return
+	}
+	if messageType != GosirisMsgMemberRemoved {
+		return
+	}
+
+	system.mutex.RLock()
+	var names []string
+	for name, association := range system.actors {
+		if !association.hosted() && association.options != nil && association.options.Node() == member.Id {
+			names = append(names, name)
+		}
+	}
+	system.mutex.RUnlock()
+
+	for _, name := range names {
+		system.removeRemoteActor(name)
+	}
+}
+
+func (system *actorSystem) resolveNodeActors(node string) {
+	if node == nodeId {
+		return
+	}
+
+	system.mutex.RLock()
+	conf := make(map[string]OptionsInterface)
+	for name, options := range system.discovered {
+		if options.Node() == node {
+			conf[name] = options
+		}
+	}
+	system.mutex.RUnlock()
+
+	for name, options := range conf {
+		system.addDiscoveredActor(name, options.(*ActorOptions))
+	}
+}
+
 func (system *actorSystem) removeRemoteActor(name string) {
 	InfoLogger.Printf("Removing remote actor %v", name)
 
@@ -195,7 +340,7 @@ func (system *actorSystem) removeRemoteActor(name string) {
 		DeleteRemoteActorConnection(name)
 	}
 
-	delete(system.actors, name)
+	system.deleteActor(name)
 
 	InfoLogger.Printf("Remote actor %v removed", name)
 }
@@ -232,16 +377,23 @@ func (system *actorSystem) closeLocalActor(name string) {
 		c <- 0
 	}
 
+	if v.options.Remote() {
+		DeleteRemoteActorConnection(name)
+	}
+
 	if registry != nil {
 		registry.UnregisterActor(name)
 	}
 
-	delete(system.actors, name)
+	system.deleteActor(name)
 
 	InfoLogger.Printf("%v unregistered from the actor system", name)
 }
 
 func (system *actorSystem) actor(name string) (actorAssociation, error) {
+	system.mutex.RLock()
+	defer system.mutex.RUnlock()
+
 	ref, exists := system.actors[name]
 	if !exists {
 		return actorAssociation{}, fmt.Errorf("actor %v not registered", name)
@@ -250,18 +402,85 @@ func (system *actorSystem) actor(name string) (actorAssociation, error) {
 	return ref, nil
 }
 
+func (system *actorSystem) setActor(name string, association actorAssociation) {
+	system.mutex.Lock()
+	defer system.mutex.Unlock()
+
+	system.actors[name] = association
+}
+
+//The check and the registration are done atomically, unlike actor followed by setActor
+func (system *actorSystem) setActorIfAbsent(name string, association actorAssociation) bool {
+	system.mutex.Lock()
+	defer system.mutex.Unlock()
+
+	if _, exists := system.actors[name]; exists {
+		return false
+	}
+	system.actors[name] = association
+
+	return true
+}
+
+func (system *actorSystem) deleteActor(name string) {
+	system.mutex.Lock()
+	defer system.mutex.Unlock()
+
+	delete(system.actors, name)
+}
+
+//Returns the actor hosted by this system consuming a remote destination
+func (system *actorSystem) consumerOf(remoteType string, destination string) (ActorRefInterface, error) {
+	system.mutex.RLock()
+	defer system.mutex.RUnlock()
+
+	for _, v := range system.actors {
+		if !v.hosted() || !v.options.Remote() {
+			continue
+		}
+		if v.options.RemoteType() == remoteType && v.options.Destination() == destination {
+			return v.actorRef, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no actor consuming destination %v", destination)
+}
+
 func (system *actorSystem) addRemoteActors(configuration map[string]OptionsInterface) {
+	system.mutex.Lock()
+	defer system.mutex.Unlock()
+
 	for k, v := range configuration {
 		actor := Actor{}
 		actor.setName(k)
 		actorRef := newActorRef(k)
 
 		system.actors[k] = actorAssociation{actorRef, &actor, v}
+		system.discovered[k] = v
 	}
 
 	InfoLogger.Printf("Actors configuration: %v", system.actors)
 }
 
+//Registers a reference to remote actors without consuming its destination,
+//e.g. to tell a group of actors bound to an AMQP exchange
+func (system *actorSystem) RegisterRemoteActor(name string, options OptionsInterface) error {
+	if !options.Remote() {
+		ErrorLogger.Printf("Actor %v is not remote", name)
+		return fmt.Errorf("actor %v is not remote", name)
+	}
+
+	actor := Actor{}
+	actor.setName(name)
+
+	AddConnection(name, options)
+	system.setActor(name, actorAssociation{newActorRef(name), &actor, options})
+
+	InfoLogger.Printf("Remote actor %v registered", name)
+
+	return nil
+}
+
 func (system *actorSystem) ActorOf(name string) (ActorRefInterface, error) {
 	actorAssociation, err := system.actor(name)
 
@@ -272,6 +491,32 @@ func (system *actorSystem) ActorOf(name string) (ActorRefInterface, error) {
 	return actorAssociation.actorRef, err
 }
 
+//Finds the actors, local or discovered through the registry, whose labels match a selector (e.g. role=billing,region in (eu,us)).
+//The actors are sorted by name.
+func (system *actorSystem) Find(s string) ([]ActorRefInterface, error) {
+	sel, err := parseSelector(s)
+	if err != nil {
+		return nil, err
+	}
+
+	system.mutex.RLock()
+	var names []string
+	for name, association := range system.actors {
+		if association.options != nil && sel.matches(association.options.Labels()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	refs := make([]ActorRefInterface, 0, len(names))
+	for _, name := range names {
+		refs = append(refs, system.actors[name].actorRef)
+	}
+	system.mutex.RUnlock()
+
+	return refs, nil
+}
+
 func (system *actorSystem) Invoke(message Context) error {
 	if message.Self == nil {
 		return nil
@@ -282,7 +527,7 @@ func (system *actorSystem) Invoke(message Context) error {
 	actorAssociation, err := system.actor(message.Self.Name())
 
 	if err != nil {
-		ErrorLogger.Printf("Invoke error: actor %v not registered", actorAssociation.actorRef.Name())
+		ErrorLogger.Printf("Invoke error: actor %v not registered", message.Self.Name())
 		return err
 	}
 
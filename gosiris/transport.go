@@ -1,24 +1,49 @@
 package gosiris
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+)
+
+//Transport options shared by the transports supporting TLS
+const (
+	TlsCa       = "tls.ca"       //CA certificate file used to verify the peer
+	TlsCert     = "tls.cert"     //Certificate file presented to the peer
+	TlsKey      = "tls.key"      //Private key file of tls.cert
+	TlsInsecure = "tls.insecure" //true to skip the peer verification
 )
 
 var remoteConnections map[string]TransportInterface
+var remoteConnectionsMutex sync.RWMutex
 var transportTypes map[string]func() TransportInterface
 
+//Transport options kept out of the registry records (e.g. the passwords) and the secrets set locally per url
+var secretTransportOptions = make(map[string]bool)
+var transportSecrets = make(map[string]map[string]string)
+var transportSecretsMutex sync.Mutex
+
 func init() {
 	transportTypes = make(map[string]func() TransportInterface)
+	remoteConnections = make(map[string]TransportInterface)
 }
 
 type TransportInterface interface {
-	Configure(string, map[string]string)
+	Configure(string, map[string]string) error
 	Connection() error
 	Send(string, []byte) error
 	Receive(string)
 	Close()
 }
 
+//Implemented by the transports needing the context of a message besides its encoding
+type contextTransport interface {
+	SendContext(string, Context, []byte) error
+}
+
 func registerTransport(name string, f func() TransportInterface) {
 	transportTypes[name] = f
 }
@@ -27,17 +52,76 @@ func newTransport(name string) TransportInterface {
 	return transportTypes[name]()
 }
 
+func registerSecretTransportOption(key string) {
+	secretTransportOptions[key] = true
+}
+
+//Sets a secret transport option (e.g. sasl.password or password) used to connect to a url. The secret options are not
+//published to the registry: the actor systems discovering an actor set them locally for the url of its transport.
+//The secrets of the actors registered by this actor system are set implicitly.
+func SetTransportSecret(url string, key string, value string) {
+	transportSecretsMutex.Lock()
+	defer transportSecretsMutex.Unlock()
+
+	if transportSecrets[url] == nil {
+		transportSecrets[url] = make(map[string]string)
+	}
+	transportSecrets[url][key] = value
+}
+
+//Transport options of an actor completed with the secrets set for its url
+func transportOptionsOf(options OptionsInterface) map[string]string {
+	merged := make(map[string]string)
+	for k, v := range options.TransportOptions() {
+		merged[k] = v
+		if secretTransportOptions[k] {
+			SetTransportSecret(options.Url(), k, v)
+		}
+	}
+
+	transportSecretsMutex.Lock()
+	defer transportSecretsMutex.Unlock()
+
+	for k, v := range transportSecrets[options.Url()] {
+		if _, exists := merged[k]; !exists {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+//Transport options published to the registry, without the secret ones
+func publishedTransportOptions(options map[string]string) map[string]string {
+	var published map[string]string
+	for k, v := range options {
+		if secretTransportOptions[k] {
+			continue
+		}
+		if published == nil {
+			published = make(map[string]string)
+		}
+		published[k] = v
+	}
+
+	return published
+}
+
 func InitRemoteConnections(configuration map[string]OptionsInterface) {
+	remoteConnectionsMutex.Lock()
+	defer remoteConnectionsMutex.Unlock()
+
 	remoteConnections = make(map[string]TransportInterface)
 
 	for k, v := range configuration {
 		c := transportTypes[v.RemoteType()]()
 
-		c.Configure(v.Url(), nil)
-		err := c.Connection()
+		err := c.Configure(v.Url(), transportOptionsOf(v))
 		if err != nil {
-			ErrorLogger.Printf("Failed to initialize the connection with %v: %v", v, err)
+			ErrorLogger.Printf("Invalid configuration of the connection with %v: %v", v, err)
+			continue
 		}
+		connect(k, c)
 		remoteConnections[k] = c
 	}
 
@@ -47,16 +131,39 @@ func InitRemoteConnections(configuration map[string]OptionsInterface) {
 func AddConnection(name string, conf OptionsInterface) {
 	c := transportTypes[conf.RemoteType()]()
 
-	c.Configure(conf.Url(), nil)
+	err := c.Configure(conf.Url(), transportOptionsOf(conf))
+	if err != nil {
+		ErrorLogger.Printf("Invalid configuration of the connection with %v: %v", name, err)
+		return
+	}
+	connect(name, c)
+	setRemoteConnection(name, c)
+	InfoLogger.Printf("Remote connection %v added", name)
+}
+
+func setRemoteConnection(name string, c TransportInterface) {
+	remoteConnectionsMutex.Lock()
+	defer remoteConnectionsMutex.Unlock()
+
+	remoteConnections[name] = c
+}
+
+//A transport failing to connect keeps on trying in the background if it supports reconnection
+func connect(name string, c TransportInterface) {
 	err := c.Connection()
 	if err != nil {
 		ErrorLogger.Printf("Failed to initialize the connection with %v: %v", name, err)
+
+		if r, ok := c.(reconnectableTransport); ok {
+			r.Reconnect()
+		}
 	}
-	remoteConnections[name] = c
-	InfoLogger.Printf("Remote connection %v added", name)
 }
 
 func DeleteRemoteActorConnection(name string) error {
+	remoteConnectionsMutex.Lock()
+	defer remoteConnectionsMutex.Unlock()
+
 	v, exists := remoteConnections[name]
 	if !exists {
 		ErrorLogger.Printf("Delete error: connection %v not registered", name)
@@ -72,6 +179,9 @@ func DeleteRemoteActorConnection(name string) error {
 }
 
 func RemoteConnection(name string) (TransportInterface, error) {
+	remoteConnectionsMutex.RLock()
+	defer remoteConnectionsMutex.RUnlock()
+
 	v, exists := remoteConnections[name]
 	if !exists {
 		ErrorLogger.Printf("Remote connection error: connection %v not registered", name)
@@ -80,3 +190,79 @@ func RemoteConnection(name string) (TransportInterface, error) {
 
 	return v, nil
 }
+
+func validateTransportOptions(transport string, options map[string]string, accepted ...string) error {
+	for k := range options {
+		valid := false
+		for _, v := range accepted {
+			if k == v {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return fmt.Errorf("option %v not supported by the %v transport", k, transport)
+		}
+	}
+
+	return nil
+}
+
+func boolTransportOption(options map[string]string, key string) (bool, error) {
+	v, exists := options[key]
+	if !exists {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %v for option %v: %v", v, key, err)
+	}
+
+	return b, nil
+}
+
+//Returns nil if none of the TLS options is set
+func tlsConfig(options map[string]string) (*tls.Config, error) {
+	_, ca := options[TlsCa]
+	_, cert := options[TlsCert]
+	_, key := options[TlsKey]
+	insecure, err := boolTransportOption(options, TlsInsecure)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ca && !cert && !key && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if ca {
+		pem, err := ioutil.ReadFile(options[TlsCa])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", options[TlsCa], err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", options[TlsCa])
+		}
+		config.ClientCAs = config.RootCAs
+	}
+
+	if cert != key {
+		return nil, fmt.Errorf("options %v and %v must be set together", TlsCert, TlsKey)
+	}
+
+	if cert {
+		c, err := tls.LoadX509KeyPair(options[TlsCert], options[TlsKey])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the key pair %v: %v", options[TlsCert], err)
+		}
+		config.Certificates = []tls.Certificate{c}
+	}
+
+	return config, nil
+}
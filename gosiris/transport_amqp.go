@@ -2,116 +2,718 @@ package gosiris
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/streadway/amqp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var Amqp = "amqp"
 
+//Options supported by the AMQP transport (along with the TLS ones for amqps urls)
+const (
+	AmqpVhost     = "vhost"     //Virtual host, overriding the one of the url
+	AmqpHeartbeat = "heartbeat" //Heartbeat interval (e.g. 10s)
+	AmqpPrefetch  = "prefetch"  //Number of messages delivered to a consumer before being acknowledged
+	AmqpPassword  = "password"  //Password of the user of the url (default: guest), not published to the registry unlike the url
+
+	AmqpDelivery           = "delivery"             //AmqpAtMostOnce (default) or AmqpAtLeastOnce
+	AmqpDeadLetterExchange = "dead.letter.exchange" //Exchange receiving the messages whose invocation failed
+	AmqpMaxDeliveries      = "max.deliveries"       //Deliveries of a failing message before it is rejected, without dead-letter exchange (default 2)
+	AmqpConfirmTimeout     = "confirm.timeout"      //Maximum time to wait for a publisher confirm (default 5s)
+
+	AmqpExchange     = "exchange"      //Exchange the messages are published to, instead of the default one
+	AmqpExchangeType = "exchange.type" //amqp.ExchangeDirect (default), amqp.ExchangeFanout, amqp.ExchangeTopic or amqp.ExchangeHeaders
+	AmqpBindingKeys  = "binding.keys"  //Comma separated keys binding the destination queue to the exchange, besides the destination for the direct and topic exchanges
+	AmqpRoutingKey   = "routing.key"   //Routing key of the published messages (default: the destination)
+)
+
+//Delivery modes of the AMQP transport.
+//At least once relies on durable queues, persistent messages, publisher confirms and manual acknowledgements.
+const (
+	AmqpAtMostOnce  = "at-most-once"
+	AmqpAtLeastOnce = "at-least-once"
+)
+
+const (
+	defaultAmqpConfirmTimeout = 5 * time.Second
+	defaultAmqpMaxDeliveries  = 2
+
+	//Deliveries counted by the quorum queues, and failed deliveries of a message published again by gosiris otherwise
+	amqpHeaderDeliveryCount = "x-delivery-count"
+	amqpHeaderDeliveries    = "gosiris-deliveries"
+
+	//Defaults of amqp.Dial, not applied by amqp.DialConfig
+	defaultAmqpHeartbeat = 10 * time.Second
+	defaultAmqpLocale    = "en_US"
+)
+
 type amqpTransport struct {
-	url        string
-	connection *amqp.Connection
-	channel    *amqp.Channel
+	url                string
+	config             amqp.Config
+	prefetch           int
+	atLeastOnce        bool
+	deadLetterExchange string
+	maxDeliveries      int
+	confirmTimeout     time.Duration
+	exchange           string
+	exchangeType       string
+	bindingKeys        []string
+	routingKey         string
+	connection         *amqp.Connection
+	channel            *amqp.Channel
+	confirms           *amqpConfirms
+	state              *connectionState
+	mutex              sync.RWMutex
+	publishMutex       sync.Mutex
+}
+
+//Publisher confirms of a channel, drained as soon as received so that a late confirm never blocks the connection
+type amqpConfirms struct {
+	published uint64 //Delivery tag of the last message published on the channel
+	waiting   map[uint64]chan bool
+	closed    bool
+	mutex     sync.Mutex
 }
 
 func init() {
 	registerTransport(Amqp, newAmqpTransport)
+	registerSecretTransportOption(AmqpPassword)
 }
 
 func newAmqpTransport() TransportInterface {
-	return new(amqpTransport)
+	return &amqpTransport{
+		confirmTimeout: defaultAmqpConfirmTimeout,
+		maxDeliveries:  defaultAmqpMaxDeliveries,
+		state:          newConnectionState(),
+	}
 }
 
-func (a *amqpTransport) Configure(url string, options map[string]string) {
+func (a *amqpTransport) Configure(url string, options map[string]string) error {
 	a.url = url
+
+	err := validateTransportOptions(Amqp, options, AmqpVhost, AmqpHeartbeat, AmqpPrefetch, AmqpPassword, AmqpDelivery, AmqpDeadLetterExchange, AmqpMaxDeliveries, AmqpConfirmTimeout, AmqpExchange, AmqpExchangeType, AmqpBindingKeys, AmqpRoutingKey, ReconnectInitial, ReconnectMax, ReconnectBuffer, TlsCa, TlsCert, TlsKey, TlsInsecure)
+	if err != nil {
+		return err
+	}
+
+	a.config.Vhost = options[AmqpVhost]
+	a.config.SASL = nil
+	if password, exists := options[AmqpPassword]; exists {
+		uri, err := amqp.ParseURI(url)
+		if err != nil {
+			return fmt.Errorf("invalid AMQP url %v: %v", url, err)
+		}
+		a.config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: uri.Username, Password: password}}
+	}
+	a.config.Heartbeat = defaultAmqpHeartbeat
+	a.config.Locale = defaultAmqpLocale
+
+	if v, exists := options[AmqpHeartbeat]; exists {
+		a.config.Heartbeat, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, AmqpHeartbeat, err)
+		}
+	}
+
+	if v, exists := options[AmqpPrefetch]; exists {
+		a.prefetch, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, AmqpPrefetch, err)
+		}
+	}
+
+	switch options[AmqpDelivery] {
+	case "", AmqpAtMostOnce:
+	case AmqpAtLeastOnce:
+		a.atLeastOnce = true
+	default:
+		return fmt.Errorf("invalid value %v for option %v", options[AmqpDelivery], AmqpDelivery)
+	}
+
+	a.deadLetterExchange = options[AmqpDeadLetterExchange]
+
+	if v, exists := options[AmqpMaxDeliveries]; exists {
+		a.maxDeliveries, err = strconv.Atoi(v)
+		if err != nil || a.maxDeliveries < 1 {
+			return fmt.Errorf("invalid value %v for option %v", v, AmqpMaxDeliveries)
+		}
+	}
+
+	if v, exists := options[AmqpConfirmTimeout]; exists {
+		a.confirmTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, AmqpConfirmTimeout, err)
+		}
+	}
+
+	a.exchange = options[AmqpExchange]
+	a.routingKey = options[AmqpRoutingKey]
+
+	switch options[AmqpExchangeType] {
+	case "":
+		a.exchangeType = amqp.ExchangeDirect
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+		a.exchangeType = options[AmqpExchangeType]
+	default:
+		return fmt.Errorf("invalid value %v for option %v", options[AmqpExchangeType], AmqpExchangeType)
+	}
+
+	if v, exists := options[AmqpBindingKeys]; exists {
+		a.bindingKeys = strings.Split(v, ",")
+	}
+
+	if a.exchangeType == amqp.ExchangeHeaders {
+		for _, k := range append(a.bindingKeys, a.routingKey) {
+			if _, err := amqpHeaders(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.config.TLSClientConfig, err = tlsConfig(options)
+	if err != nil {
+		return err
+	}
+
+	return a.state.configure(url, options)
 }
 
 func (a *amqpTransport) Connection() error {
-	c, err := amqp.Dial(a.url)
+	c, err := amqp.DialConfig(a.url, a.config)
 	if err != nil {
 		ErrorLogger.Printf("Failed to connect to the AMQP server %v", a.url)
 		return err
 	}
-	a.connection = c
 
 	ch, err := c.Channel()
 	if err != nil {
 		ErrorLogger.Printf("Failed to open an AMQP channel on the server %v", a.url)
+		c.Close()
 		return err
 	}
+
+	var confirms *amqpConfirms
+	if a.atLeastOnce {
+		err = ch.Confirm(false)
+		if err != nil {
+			ErrorLogger.Printf("Failed to enable the publisher confirms on the server %v", a.url)
+			c.Close()
+			return err
+		}
+		confirms = newAmqpConfirms(ch.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	}
+
+	a.mutex.Lock()
+	previous := a.connection
+	a.connection = c
 	a.channel = ch
+	a.confirms = confirms
+	a.mutex.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	//A connection or a channel closed by the server or by a network failure is notified with a non nil error
+	connectionClosed := c.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		var err *amqp.Error
+		select {
+		case err = <-connectionClosed:
+		case err = <-channelClosed:
+		}
+
+		if err != nil {
+			ErrorLogger.Printf("AMQP connection to %v closed: %v", a.url, err)
+			a.state.lost(a.Connection)
+		}
+	}()
 
 	InfoLogger.Printf("Connected to %v", a.url)
 
+	for _, m := range a.state.established() {
+		err := a.publish(m.destination, m.data)
+		if err != nil {
+			ErrorLogger.Printf("Failed to send the buffered message to %v: %v", m.destination, err)
+		}
+	}
+
 	return nil
 }
 
+func (a *amqpTransport) Reconnect() {
+	a.state.lost(a.Connection)
+}
+
 func (a *amqpTransport) Receive(queueName string) {
-	q, err := a.channel.QueueDeclare(
-		queueName, // name
-		false,     // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
+	for {
+		lost, ok := a.state.wait()
+		if !ok {
+			return
+		}
+
+		a.consume(queueName, lost)
+	}
+}
 
+//Consumes until the connection is lost, the queue being declared again after each reconnection
+func (a *amqpTransport) consume(queueName string, lost <-chan struct{}) {
+	a.mutex.RLock()
+	ch := a.channel
+	a.mutex.RUnlock()
+
+	q, err := a.declareQueue(ch, queueName)
 	if err != nil {
 		ErrorLogger.Printf("Error while declaring queue %v: %v", queueName, err)
+		<-lost
+		return
+	}
+
+	if a.exchange != "" {
+		err = a.bindQueue(ch, q.Name)
+		if err != nil {
+			ErrorLogger.Printf("Error while binding queue %v to exchange %v: %v", queueName, a.exchange, err)
+			<-lost
+			return
+		}
 	}
 
-	msgs, _ := a.channel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
+	if a.prefetch > 0 {
+		err = ch.Qos(a.prefetch, 0, false)
+		if err != nil {
+			ErrorLogger.Printf("Error while setting the prefetch count of queue %v: %v", queueName, err)
+		}
+	}
+
+	msgs, err := ch.Consume(
+		q.Name,         // queue
+		"",             // consumer
+		!a.atLeastOnce, // auto-ack
+		false,          // exclusive
+		false,          // no-local
+		false,          // no-wait
+		nil,            // args
 	)
+	if err != nil {
+		ErrorLogger.Printf("Error while consuming queue %v: %v", queueName, err)
+		<-lost
+		return
+	}
+
 	for d := range msgs {
-		msg := Context{}
-		json.Unmarshal(d.Body, &msg)
+		msg, err := a.decode(queueName, d.Body)
+		if err != nil {
+			ErrorLogger.Printf("Failed to decode AMQP message %v: %v", d.DeliveryTag, err)
+			if a.atLeastOnce {
+				a.acknowledge(q.Name, d, err, false)
+			}
+			continue
+		}
+
 		InfoLogger.Printf("New AMQP message received: %v", msg)
-		ActorSystem().Invoke(msg)
+		err = invoke(msg)
+		if a.atLeastOnce {
+			a.acknowledge(q.Name, d, err, true)
+		}
+	}
+
+	<-lost
+}
+
+//A message routed by an exchange is addressed to the actor hosted by this system consuming the queue
+//rather than to the one it was told to (e.g. a group)
+func (a *amqpTransport) decode(queueName string, body []byte) (Context, error) {
+	msg := Context{}
+
+	if a.exchange != "" {
+		self, err := ActorSystem().consumerOf(Amqp, queueName)
+		if err != nil {
+			ErrorLogger.Printf("Failed to route AMQP message from queue %v: %v", queueName, err)
+			return msg, err
+		}
+
+		var m map[string]interface{}
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			return msg, err
+		}
+		m[jsonSelf] = self.Name()
+
+		body, err = json.Marshal(m)
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	err := json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+//A failed message is dead-lettered if an exchange is configured. Otherwise it is retried until delivered max.deliveries
+//times if it can be retried (e.g. its invocation failed), and dropped if it cannot (e.g. it cannot be decoded).
+//A quorum queue counting the deliveries, the message is requeued. Otherwise, it is published again to its queue
+//with the number of its failed deliveries, the redelivered flag not telling how many times it has been delivered.
+func (a *amqpTransport) acknowledge(queueName string, d amqp.Delivery, err error, retry bool) {
+	if err == nil {
+		err = d.Ack(false)
+		if err != nil {
+			ErrorLogger.Printf("Failed to acknowledge AMQP message %v: %v", d.DeliveryTag, err)
+		}
+		return
+	}
+
+	deliveries := amqpDeliveries(d)
+	if a.deadLetterExchange != "" || !retry || deliveries >= a.maxDeliveries {
+		ErrorLogger.Printf("Failed to process AMQP message %v, rejected after %v deliveries: %v", d.DeliveryTag, deliveries, err)
+		a.reject(d, false)
+		return
+	}
+
+	ErrorLogger.Printf("Failed to process AMQP message %v, retried after %v deliveries: %v", d.DeliveryTag, deliveries, err)
+	if _, exists := d.Headers[amqpHeaderDeliveryCount]; exists {
+		a.reject(d, true)
+		return
+	}
+
+	err = a.retry(queueName, d, deliveries)
+	if err != nil {
+		ErrorLogger.Printf("Failed to publish AMQP message %v again, requeued: %v", d.DeliveryTag, err)
+		a.reject(d, true)
+		return
+	}
+
+	err = d.Ack(false)
+	if err != nil {
+		ErrorLogger.Printf("Failed to acknowledge AMQP message %v: %v", d.DeliveryTag, err)
+	}
+}
+
+func (a *amqpTransport) reject(d amqp.Delivery, requeue bool) {
+	err := d.Nack(false, requeue)
+	if err != nil {
+		ErrorLogger.Printf("Failed to reject AMQP message %v: %v", d.DeliveryTag, err)
+	}
+}
+
+//Number of the delivery of a message, counting the deliveries of the copies published again before it
+func amqpDeliveries(d amqp.Delivery) int {
+	return amqpTableInt(d.Headers, amqpHeaderDeliveryCount) + amqpTableInt(d.Headers, amqpHeaderDeliveries) + 1
+}
+
+func amqpTableInt(table amqp.Table, key string) int {
+	switch v := table[key].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+
+	return 0
+}
+
+func (a *amqpTransport) declareQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	var args amqp.Table
+	if a.deadLetterExchange != "" {
+		args = amqp.Table{"x-dead-letter-exchange": a.deadLetterExchange}
+	}
+
+	return ch.QueueDeclare(
+		name,          // name
+		a.atLeastOnce, // durable
+		false,         // delete when unused
+		false,         // exclusive
+		false,         // no-wait
+		args,          // arguments
+	)
+}
+
+func (a *amqpTransport) declareExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		a.exchange,     // name
+		a.exchangeType, // type
+		a.atLeastOnce,  // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
+	)
+}
+
+func (a *amqpTransport) bindQueue(ch *amqp.Channel, queueName string) error {
+	err := a.declareExchange(ch)
+	if err != nil {
+		return err
 	}
+
+	for _, key := range a.bindingKeysOf(queueName) {
+		var args amqp.Table
+		if a.exchangeType == amqp.ExchangeHeaders {
+			//The queue is bound if all the headers match
+			args, _ = amqpHeaders(key)
+			args["x-match"] = "all"
+			key = ""
+		}
+
+		err = ch.QueueBind(queueName, key, a.exchange, false, args)
+		if err != nil {
+			return err
+		}
+		InfoLogger.Printf("Queue %v bound to exchange %v with key %v", queueName, a.exchange, key)
+	}
+
+	return nil
+}
+
+//A direct or topic queue is also bound to its own name, the messages told to its actor being published with it as routing key
+func (a *amqpTransport) bindingKeysOf(queueName string) []string {
+	if a.bindingKeys == nil {
+		return []string{queueName}
+	}
+	if a.exchangeType != amqp.ExchangeDirect && a.exchangeType != amqp.ExchangeTopic {
+		return a.bindingKeys
+	}
+
+	for _, key := range a.bindingKeys {
+		if key == queueName {
+			return a.bindingKeys
+		}
+	}
+
+	return append([]string{queueName}, a.bindingKeys...)
+}
+
+//Parses the headers of a headers exchange key, e.g. region=eu;type=order
+func amqpHeaders(key string) (amqp.Table, error) {
+	headers := amqp.Table{}
+	if key == "" {
+		return headers, nil
+	}
+
+	for _, h := range strings.Split(key, ";") {
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid header %v in key %v, expected name=value", h, key)
+		}
+		headers[kv[0]] = kv[1]
+	}
+
+	return headers, nil
 }
 
 func (a *amqpTransport) Close() {
-	a.channel.Close()
-	a.connection.Close()
+	a.state.close()
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.channel != nil {
+		a.channel.Close()
+	}
+	if a.connection != nil {
+		a.connection.Close()
+	}
 }
 
 func (a *amqpTransport) Send(destination string, data []byte) error {
 	InfoLogger.Printf("Sending message to the AMQP destination %v", destination)
 
-	q, err := a.channel.QueueDeclare(
-		destination, // name
-		false,       // durable
-		false,       // delete when unused
-		false,       // exclusive
-		false,       // no-wait
-		nil,         // arguments
-	)
+	held, err := a.state.hold(destination, EmptyContext, data)
+	if held {
+		return err
+	}
+
+	return a.publish(destination, data)
+}
+
+func (a *amqpTransport) publish(destination string, data []byte) error {
+	//Publications are serialized so that each confirm matches its message
+	a.publishMutex.Lock()
+	defer a.publishMutex.Unlock()
+
+	a.mutex.RLock()
+	ch := a.channel
+	confirms := a.confirms
+	a.mutex.RUnlock()
+
+	exchange, routingKey, headers, err := a.route(ch, destination)
 	if err != nil {
-		ErrorLogger.Printf("Error while declaring queue %v: %v", destination, err)
+		ErrorLogger.Printf("Error while declaring the route to %v: %v", destination, err)
 		return err
 	}
 
-	body := data
-	err = a.channel.Publish(
-		"",     // exchange
-		q.Name, // routing key
-		false,  // mandatory
-		false,  // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-		})
+	deliveryMode := amqp.Transient
+	if a.atLeastOnce {
+		deliveryMode = amqp.Persistent
+	}
+
+	return a.send(ch, confirms, exchange, routingKey, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "text/plain",
+		DeliveryMode: deliveryMode,
+		Body:         data,
+	}, destination)
+}
+
+//Publishes a failed message again to the queue it has been consumed from
+func (a *amqpTransport) retry(queueName string, d amqp.Delivery, deliveries int) error {
+	a.publishMutex.Lock()
+	defer a.publishMutex.Unlock()
+
+	a.mutex.RLock()
+	ch := a.channel
+	confirms := a.confirms
+	a.mutex.RUnlock()
+
+	if ch == nil {
+		return ErrTransportDisconnected
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	delete(headers, amqpHeaderDeliveryCount)
+	headers[amqpHeaderDeliveries] = int32(deliveries)
+
+	return a.send(ch, confirms, "", queueName, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: d.DeliveryMode,
+		Body:         d.Body,
+	}, queueName)
+}
+
+//Publishes a message, waiting for its confirm if enabled
+func (a *amqpTransport) send(ch *amqp.Channel, confirms *amqpConfirms, exchange string, routingKey string, msg amqp.Publishing, destination string) error {
+	//The delivery tag of the message is only taken if it is published
+	var tag uint64
+	var confirmed chan bool
+	if confirms != nil {
+		tag, confirmed = confirms.expect()
+	}
+
+	err := ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg)
 
 	if err != nil {
+		if confirms != nil {
+			confirms.cancel(tag)
+		}
 		ErrorLogger.Printf("Error while publishing a message to queue %v: %v", destination, err)
 		return err
 	}
 
-	return nil
+	if confirms == nil {
+		return nil
+	}
+	confirms.sent()
+
+	select {
+	case ack, ok := <-confirmed:
+		if !ok {
+			return ErrTransportDisconnected
+		}
+		if !ack {
+			return fmt.Errorf("message to queue %v not confirmed by the server", destination)
+		}
+		return nil
+	case <-time.After(a.confirmTimeout):
+		confirms.cancel(tag)
+		return fmt.Errorf("no confirm received for the message to queue %v after %v", destination, a.confirmTimeout)
+	}
+}
+
+func newAmqpConfirms(notify chan amqp.Confirmation) *amqpConfirms {
+	c := &amqpConfirms{waiting: make(map[uint64]chan bool)}
+	go c.drain(notify)
+
+	return c
+}
+
+//The confirms of the messages no longer waited for (e.g. timed out) are dropped
+func (c *amqpConfirms) drain(notify chan amqp.Confirmation) {
+	for confirm := range notify {
+		c.mutex.Lock()
+		if confirmed, exists := c.waiting[confirm.DeliveryTag]; exists {
+			confirmed <- confirm.Ack
+			delete(c.waiting, confirm.DeliveryTag)
+		}
+		c.mutex.Unlock()
+	}
+
+	//The channel is closed
+	c.mutex.Lock()
+	c.closed = true
+	for tag, confirmed := range c.waiting {
+		close(confirmed)
+		delete(c.waiting, tag)
+	}
+	c.mutex.Unlock()
+}
+
+//Waits for the confirm of the next message published, the publications being serialized
+func (c *amqpConfirms) expect() (uint64, chan bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tag := c.published + 1
+	confirmed := make(chan bool, 1)
+	if c.closed {
+		close(confirmed)
+	} else {
+		c.waiting[tag] = confirmed
+	}
+
+	return tag, confirmed
+}
+
+func (c *amqpConfirms) sent() {
+	c.mutex.Lock()
+	c.published++
+	c.mutex.Unlock()
+}
+
+func (c *amqpConfirms) cancel(tag uint64) {
+	c.mutex.Lock()
+	delete(c.waiting, tag)
+	c.mutex.Unlock()
+}
+
+//Without exchange, a message is published to the destination queue through the default exchange
+func (a *amqpTransport) route(ch *amqp.Channel, destination string) (string, string, amqp.Table, error) {
+	if a.exchange == "" {
+		q, err := a.declareQueue(ch, destination)
+		return "", q.Name, nil, err
+	}
+
+	err := a.declareExchange(ch)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	routingKey := a.routingKey
+	if routingKey == "" {
+		routingKey = destination
+	}
+
+	if a.exchangeType == amqp.ExchangeHeaders {
+		headers, err := amqpHeaders(a.routingKey)
+		return a.exchange, "", headers, err
+	}
+
+	return a.exchange, routingKey, nil, nil
 }
@@ -0,0 +1,319 @@
+package gosiris
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"io"
+	"net"
+	"sync"
+)
+
+var Grpc = "grpc"
+
+const (
+	grpcCodecName     = "gosiris"
+	grpcDeliverMethod = "/gosiris.Transport/Deliver"
+)
+
+//Each actor system exposes a single bidirectional Deliver stream per listening address.
+//The client sends envelopes, the server acknowledges each of them once posted to the mailbox of its destination,
+//the messages of a destination being invoked one at a time whatever the stream they are received on.
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gosiris.Transport",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Deliver",
+			Handler:       grpcDeliverHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+var grpcServers = make(map[string]*grpcServer)
+var grpcServersMutex sync.Mutex
+
+type grpcEnvelope struct {
+	Destination string `json:"destination"`
+	Data        []byte `json:"data"`
+}
+
+type grpcAck struct {
+	Error string `json:"error,omitempty"`
+}
+
+//The messages are already JSON encoded so we do not rely on protobuf generated code
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (grpcCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (grpcCodec) Name() string {
+	return grpcCodecName
+}
+
+type grpcServer struct {
+	url          string
+	server       *grpc.Server
+	destinations map[string]int
+	mailboxes    map[string]*remoteMailbox
+	mutex        sync.Mutex
+}
+
+type grpcTransport struct {
+	url        string
+	tls        *tls.Config
+	connection *grpc.ClientConn
+	stream     grpc.ClientStream
+	cancel     context.CancelFunc
+	done       chan struct{}
+	mutex      sync.Mutex
+}
+
+func init() {
+	encoding.RegisterCodec(grpcCodec{})
+	registerTransport(Grpc, newGrpcTransport)
+}
+
+func newGrpcTransport() TransportInterface {
+	return &grpcTransport{done: make(chan struct{})}
+}
+
+//The gRPC transport supports the TLS options, mutual TLS being enabled as soon as tls.ca is set
+func (g *grpcTransport) Configure(url string, options map[string]string) error {
+	g.url = url
+
+	err := validateTransportOptions(Grpc, options, TlsCa, TlsCert, TlsKey, TlsInsecure)
+	if err != nil {
+		return err
+	}
+
+	g.tls, err = tlsConfig(options)
+
+	return err
+}
+
+func (g *grpcTransport) Connection() error {
+	creds := insecure.NewCredentials()
+	if g.tls != nil {
+		creds = credentials.NewTLS(g.tls)
+	}
+
+	c, err := grpc.NewClient(g.url,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(grpcCodecName)))
+	if err != nil {
+		ErrorLogger.Printf("Failed to create a gRPC client for %v: %v", g.url, err)
+		return err
+	}
+	g.connection = c
+
+	InfoLogger.Printf("Connected to %v", g.url)
+
+	return nil
+}
+
+func (g *grpcTransport) Receive(destination string) {
+	s, err := startGrpcServer(g.url, g.tls, destination)
+	if err != nil {
+		ErrorLogger.Printf("Failed to start the gRPC server on %v: %v", g.url, err)
+		return
+	}
+
+	<-g.done
+	s.release(destination)
+}
+
+func (g *grpcTransport) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.closeStream()
+	if g.connection != nil {
+		g.connection.Close()
+	}
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
+	}
+}
+
+func (g *grpcTransport) Send(destination string, data []byte) error {
+	InfoLogger.Printf("Sending message to the gRPC destination %v", destination)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := g.connection.NewStream(ctx, &grpcServiceDesc.Streams[0], grpcDeliverMethod)
+		if err != nil {
+			cancel()
+			ErrorLogger.Printf("Failed to open a gRPC stream to %v: %v", g.url, err)
+			return err
+		}
+		g.stream = stream
+		g.cancel = cancel
+	}
+
+	err := g.stream.SendMsg(&grpcEnvelope{destination, data})
+	if err != nil {
+		ErrorLogger.Printf("Error while sending a message to the gRPC destination %v: %v", destination, err)
+		g.closeStream()
+		return err
+	}
+
+	ack := grpcAck{}
+	err = g.stream.RecvMsg(&ack)
+	if err != nil {
+		ErrorLogger.Printf("Error while waiting for the acknowledgement of %v: %v", destination, err)
+		g.closeStream()
+		return err
+	}
+
+	if ack.Error != "" {
+		return fmt.Errorf("grpc delivery error to %v: %v", destination, ack.Error)
+	}
+
+	return nil
+}
+
+func (g *grpcTransport) closeStream() {
+	if g.stream != nil {
+		g.stream.CloseSend()
+		g.cancel()
+		g.stream = nil
+		g.cancel = nil
+	}
+}
+
+func startGrpcServer(url string, t *tls.Config, destination string) (*grpcServer, error) {
+	grpcServersMutex.Lock()
+	defer grpcServersMutex.Unlock()
+
+	s, exists := grpcServers[url]
+	if !exists {
+		l, err := net.Listen("tcp", url)
+		if err != nil {
+			return nil, err
+		}
+
+		var options []grpc.ServerOption
+		if t != nil {
+			config := t.Clone()
+			if config.ClientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			options = append(options, grpc.Creds(credentials.NewTLS(config)))
+		}
+
+		s = &grpcServer{
+			url:          url,
+			server:       grpc.NewServer(options...),
+			destinations: make(map[string]int),
+			mailboxes:    make(map[string]*remoteMailbox),
+		}
+		s.server.RegisterService(&grpcServiceDesc, s)
+		grpcServers[url] = s
+
+		go func() {
+			err := s.server.Serve(l)
+			if err != nil {
+				ErrorLogger.Printf("gRPC server %v stopped: %v", url, err)
+			}
+		}()
+
+		InfoLogger.Printf("gRPC server listening on %v", url)
+	}
+
+	s.mutex.Lock()
+	if s.destinations[destination] == 0 {
+		s.mailboxes[destination] = newRemoteMailbox()
+	}
+	s.destinations[destination]++
+	s.mutex.Unlock()
+
+	return s, nil
+}
+
+func (s *grpcServer) release(destination string) {
+	grpcServersMutex.Lock()
+	defer grpcServersMutex.Unlock()
+
+	s.mutex.Lock()
+	s.destinations[destination]--
+	if s.destinations[destination] <= 0 {
+		delete(s.destinations, destination)
+		if m, exists := s.mailboxes[destination]; exists {
+			m.close()
+			delete(s.mailboxes, destination)
+		}
+	}
+	empty := len(s.destinations) == 0
+	s.mutex.Unlock()
+
+	if empty {
+		s.server.Stop()
+		delete(grpcServers, s.url)
+		InfoLogger.Printf("gRPC server %v stopped", s.url)
+	}
+}
+
+func (s *grpcServer) mailbox(destination string) (*remoteMailbox, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, exists := s.mailboxes[destination]
+	return m, exists
+}
+
+func grpcDeliverHandler(srv interface{}, stream grpc.ServerStream) error {
+	s := srv.(*grpcServer)
+
+	for {
+		envelope := grpcEnvelope{}
+		err := stream.RecvMsg(&envelope)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ack := grpcAck{}
+		m, exists := s.mailbox(envelope.Destination)
+		if !exists {
+			ack.Error = fmt.Sprintf("destination %v not served by %v", envelope.Destination, s.url)
+		} else {
+			msg := EmptyContext
+			err = json.Unmarshal(envelope.Data, &msg)
+			if err != nil {
+				ack.Error = err.Error()
+			} else {
+				InfoLogger.Printf("New gRPC message received: %v", msg)
+				err = m.post(msg)
+				if err != nil {
+					ack.Error = err.Error()
+				}
+			}
+		}
+
+		err = stream.SendMsg(&ack)
+		if err != nil {
+			return err
+		}
+	}
+}
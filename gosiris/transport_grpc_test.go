@@ -0,0 +1,175 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const grpcTestRegistry = "GOSIRIS_GRPC_REGISTRY"
+
+//Both actor systems discover the actor of the other one from the same registry file
+func grpcTestSystem(registryPath string, name string, url string, actor *Actor) {
+	InitActorSystem(SystemOptions{
+		ActorSystemName: "GrpcSystem",
+		RegistryUrl:     "file://" + registryPath,
+	})
+	ActorSystem().RegisterActor(name, actor, new(ActorOptions).SetRemote(true).SetRemoteType(Grpc).SetUrl(url).SetDestination(name))
+}
+
+func TestGrpc(t *testing.T) {
+	//Second actor system, run by a child process of the test binary
+	if path := os.Getenv(grpcTestRegistry); path != "" {
+		replied := make(chan struct{})
+		grpcTestSystem(path, "actorY", "127.0.0.1:50062", new(Actor).React("context", func(context Context) {
+			context.Self.LogInfo(context, "Received %v", context.Data)
+			context.Sender.Tell(context, "reply", "hello back", context.Self)
+			close(replied)
+		}))
+		defer CloseActorSystem()
+
+		select {
+		case <-replied:
+		case <-time.After(10 * time.Second):
+			t.Fatal("No message received")
+		}
+
+		//Serves until the parent test is over, the message told to actorY being acknowledged
+		ioutil.ReadAll(os.Stdin)
+		return
+	}
+
+	t.Log("Starting gRPC test")
+
+	path := filepath.Join(t.TempDir(), "actors.json")
+	err := ioutil.WriteFile(path, []byte(`{"actors": {
+		"actorX": {"remoteType": "grpc", "url": "127.0.0.1:50061", "destination": "actorX"},
+		"actorY": {"remoteType": "grpc", "url": "127.0.0.1:50062", "destination": "actorY"}
+	}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan interface{}, 1)
+	grpcTestSystem(path, "actorX", "127.0.0.1:50061", new(Actor).React("reply", func(context Context) {
+		context.Self.LogInfo(context, "Received %v", context.Data)
+		received <- context.Data
+	}))
+	defer CloseActorSystem()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGrpc$")
+	cmd.Env = append(os.Environ(), grpcTestRegistry+"="+path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	actorRefX, _ := ActorSystem().ActorOf("actorX")
+	actorRefY, _ := ActorSystem().ActorOf("actorY")
+
+	//Retried until the other actor system listens
+	for i := 0; ; i++ {
+		err = actorRefY.Tell(EmptyContext, "context", "hello", actorRefX)
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			cmd.Process.Kill()
+			t.Fatalf("Failed to tell actorY: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case d := <-received:
+		if d != "hello back" {
+			t.Errorf("Unexpected data %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Reply not received")
+	}
+
+	//An endpoint only delivers to the destinations it serves
+	client := newGrpcTransport()
+	client.Configure("127.0.0.1:50061", nil)
+	client.Connection()
+	defer client.Close()
+
+	data, _ := json.Marshal(Context{MessageType: "reply", Data: "hello", Sender: actorRefY, Self: actorRefX})
+	err = client.Send("actorY", data)
+	if err == nil {
+		t.Errorf("Destination actorY is not served by %v", "127.0.0.1:50061")
+	}
+}
+
+func TestGrpcSerialDelivery(t *testing.T) {
+	t.Log("Starting gRPC serial delivery test")
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	var active, overlaps int32
+	done := make(chan struct{}, 10)
+	actor := new(Actor).React("context", func(context Context) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		done <- struct{}{}
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("grpcSerialActor", actor, new(ActorOptions).SetRemote(true).SetRemoteType(Grpc).SetUrl("127.0.0.1:50063").SetDestination("grpcSerialActor"))
+	time.Sleep(100 * time.Millisecond)
+
+	actorRef, _ := ActorSystem().ActorOf("grpcSerialActor")
+	data, _ := json.Marshal(Context{MessageType: "context", Sender: actorRef, Self: actorRef})
+
+	//Messages received on distinct streams are invoked one at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		client := newGrpcTransport()
+		client.Configure("127.0.0.1:50063", nil)
+		client.Connection()
+		defer client.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				err := client.Send("grpcSerialActor", data)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Messages not received")
+		}
+	}
+
+	if atomic.LoadInt32(&overlaps) != 0 {
+		t.Errorf("Reactions invoked concurrently %v times", overlaps)
+	}
+}
@@ -1,27 +1,101 @@
 package gosiris
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/opentracing/opentracing-go"
+	"io"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var Kafka = "kafka"
 
+//Options supported by the Kafka transport (along with the TLS ones)
+const (
+	KafkaClientId      = "client.id"      //Client id sent to the brokers
+	KafkaSaslUser      = "sasl.user"      //SASL/PLAIN user
+	KafkaSaslPassword  = "sasl.password"  //SASL/PLAIN password
+	KafkaVersion       = "version"        //Kafka version of the brokers (e.g. 1.0.0, at least 0.10.2)
+	KafkaGroupId       = "group.id"       //Consumer group shared by the instances of an actor (default: the topic)
+	KafkaOffsetInitial = "offset.initial" //KafkaOffsetNewest (default) or KafkaOffsetOldest, used without committed offset
+	KafkaKeyExtractor  = "key.extractor"  //Name of the extractor registered with RegisterKeyExtractor (default: KeyedExtractor)
+	KafkaProducerMode  = "producer.mode"  //KafkaAsync (default) or KafkaSync to return the broker errors to Tell
+	KafkaCallback      = "callback"       //Name of the callback registered with RegisterKafkaCallback, invoked in async mode
+	KafkaMaxDeliveries = "max.deliveries" //Failed deliveries of a message before it is sent to the dead-letter topic (default 5)
+	KafkaDeadLetter    = "dead.letter"    //Topic receiving the messages failing max.deliveries times (default: the topic followed by .dead)
+)
+
+const (
+	KafkaOffsetNewest = "newest"
+	KafkaOffsetOldest = "oldest"
+
+	KafkaAsync = "async"
+	KafkaSync  = "sync"
+)
+
+//Invoked once a message sent in async mode has been acknowledged (err is nil) or rejected by the brokers
+type KafkaDeliveryCallback func(destination string, context Context, err error)
+
+var kafkaCallbacks = make(map[string]KafkaDeliveryCallback)
+
+func RegisterKafkaCallback(name string, f KafkaDeliveryCallback) {
+	kafkaCallbacks[name] = f
+}
+
 func init() {
 	registerTransport(Kafka, newKafkaTransport)
+	registerSecretTransportOption(KafkaSaslPassword)
 }
 
+const (
+	kafkaConsumerRetry        = time.Second
+	defaultKafkaMaxDeliveries = 5
+	kafkaDeadLetterSuffix     = ".dead"
+
+	//Record headers, available from Kafka 0.11
+	kafkaHeaderMessageType   = "gosiris-message-type"
+	kafkaHeaderSender        = "gosiris-sender"
+	kafkaHeaderCodec         = "gosiris-codec"
+	kafkaHeaderTracingPrefix = "gosiris-tracing-"
+	kafkaHeaderOrigin        = "gosiris-origin"     //Topic/partition/offset of a dead-lettered message
+	kafkaHeaderDeliveries    = "gosiris-deliveries" //Failed deliveries of a dead-lettered message
+	kafkaCodec               = "application/json"
+)
+
+//Metadata of a message sent to a dead-letter topic by the async producer, receiving its acknowledgement
+type kafkaDeadLetterAck chan error
+
 func newKafkaTransport() TransportInterface {
-	return new(kafkaTransport)
+	return &kafkaTransport{state: newConnectionState(), maxDeliveries: defaultKafkaMaxDeliveries}
 }
 
 type kafkaTransport struct {
-	url      string
-	producer sarama.AsyncProducer
-	consumer sarama.Consumer
+	url           string
+	config        *sarama.Config
+	groupId       string
+	key           func(Context) string
+	headers       bool
+	sync          bool
+	callback      KafkaDeliveryCallback
+	maxDeliveries int
+	deadLetter    string
+	client        sarama.Client
+	producer      sarama.AsyncProducer
+	syncProducer  sarama.SyncProducer
+	state         *connectionState
+	mutex         sync.RWMutex
+}
+
+//Invokes the messages of the partitions assigned to the consumer group member
+type kafkaGroupHandler struct {
+	maxDeliveries int                                                       //Unlimited if 0
+	deadLetter    func(context.Context, *sarama.ConsumerMessage, int) error //Sends a message failing maxDeliveries times
 }
 
 type accessLogEntry struct {
@@ -35,98 +109,530 @@ type accessLogEntry struct {
 	err     error
 }
 
-func (k *kafkaTransport) Configure(url string, options map[string]string) {
+func (k *kafkaTransport) Configure(url string, options map[string]string) error {
 	k.url = url
+
+	err := validateTransportOptions(Kafka, options, KafkaClientId, KafkaSaslUser, KafkaSaslPassword, KafkaVersion, KafkaGroupId, KafkaOffsetInitial, KafkaKeyExtractor, KafkaProducerMode, KafkaCallback, KafkaMaxDeliveries, KafkaDeadLetter, ReconnectInitial, ReconnectMax, ReconnectBuffer, TlsCa, TlsCert, TlsKey, TlsInsecure)
+	if err != nil {
+		return err
+	}
+
+	config := sarama.NewConfig()
+	//Minimum version supporting the record headers
+	config.Version = sarama.V0_11_0_0
+	config.Consumer.Return.Errors = true
+
+	config.Producer.RequiredAcks = sarama.WaitForLocal      // Only wait for the leader to ack
+	config.Producer.Compression = sarama.CompressionSnappy  // Compress messages
+	config.Producer.Flush.Frequency = 15 * time.Millisecond // Flush batches every 500ms
+	config.Producer.Partitioner = sarama.NewHashPartitioner // Partition according to the message key
+	config.Producer.Return.Successes = true                 // Required by the sync producer and the callbacks
+
+	if v, exists := options[KafkaClientId]; exists {
+		config.ClientID = v
+	}
+
+	if v, exists := options[KafkaVersion]; exists {
+		config.Version, err = sarama.ParseKafkaVersion(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, KafkaVersion, err)
+		}
+	}
+
+	k.groupId = options[KafkaGroupId]
+
+	k.key = keyExtractors[KeyedExtractor]
+	if v, exists := options[KafkaKeyExtractor]; exists {
+		k.key, exists = keyExtractors[v]
+		if !exists {
+			return fmt.Errorf("invalid value %v for option %v: extractor not registered", v, KafkaKeyExtractor)
+		}
+	}
+
+	switch options[KafkaOffsetInitial] {
+	case "", KafkaOffsetNewest:
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	case KafkaOffsetOldest:
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		return fmt.Errorf("invalid value %v for option %v", options[KafkaOffsetInitial], KafkaOffsetInitial)
+	}
+
+	switch options[KafkaProducerMode] {
+	case "", KafkaAsync:
+	case KafkaSync:
+		k.sync = true
+	default:
+		return fmt.Errorf("invalid value %v for option %v", options[KafkaProducerMode], KafkaProducerMode)
+	}
+
+	if v, exists := options[KafkaCallback]; exists {
+		k.callback, exists = kafkaCallbacks[v]
+		if !exists {
+			return fmt.Errorf("invalid value %v for option %v: callback not registered", v, KafkaCallback)
+		}
+	}
+
+	if v, exists := options[KafkaMaxDeliveries]; exists {
+		k.maxDeliveries, err = strconv.Atoi(v)
+		if err != nil || k.maxDeliveries < 1 {
+			return fmt.Errorf("invalid value %v for option %v", v, KafkaMaxDeliveries)
+		}
+	}
+	k.deadLetter = options[KafkaDeadLetter]
+
+	_, user := options[KafkaSaslUser]
+	_, password := options[KafkaSaslPassword]
+	if user != password {
+		return fmt.Errorf("options %v and %v must be set together", KafkaSaslUser, KafkaSaslPassword)
+	}
+	if user {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = options[KafkaSaslUser]
+		config.Net.SASL.Password = options[KafkaSaslPassword]
+	}
+
+	t, err := tlsConfig(options)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = t
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+	k.config = config
+	k.headers = config.Version.IsAtLeast(sarama.V0_11_0_0)
+
+	return k.state.configure(url, options)
 }
 
 func (k *kafkaTransport) Connection() error {
 	list := strings.Split(k.url, ",")
 
-	producer, err := newProducer(list)
+	client, err := sarama.NewClient(list, k.config)
 	if err != nil {
-		return err
+		ErrorLogger.Printf("Failed to start sarama client: %v", err)
+		return fmt.Errorf("failed to start sarama client: %v", err)
 	}
 
-	consumer, err := newConsumer(list)
+	var producer sarama.AsyncProducer
+	var syncProducer sarama.SyncProducer
+	if k.sync {
+		syncProducer, err = sarama.NewSyncProducerFromClient(client)
+	} else {
+		producer, err = sarama.NewAsyncProducerFromClient(client)
+	}
 	if err != nil {
-		return err
+		ErrorLogger.Printf("Failed to start sarama producer: %v", err)
+		client.Close()
+		return fmt.Errorf("failed to start sarama producer: %v", err)
 	}
 
+	k.mutex.Lock()
+	previousProducer, previousSyncProducer, previousClient := k.producer, k.syncProducer, k.client
 	k.producer = producer
-	k.consumer = consumer
+	k.syncProducer = syncProducer
+	k.client = client
+	k.mutex.Unlock()
+
+	if previousProducer != nil {
+		previousProducer.AsyncClose()
+	}
+	if previousSyncProducer != nil {
+		previousSyncProducer.Close()
+	}
+	if previousClient != nil {
+		previousClient.Close()
+	}
+
+	if producer != nil {
+		go k.acknowledgements(producer)
+	}
+
+	InfoLogger.Printf("Connected to %v", k.url)
+
+	for _, m := range k.state.established() {
+		err := k.publish(m.destination, m.context, m.data)
+		if err != nil {
+			ErrorLogger.Printf("Failed to send the buffered message to %v: %v", m.destination, err)
+		}
+	}
 
 	return nil
 }
 
+func (k *kafkaTransport) acknowledgements(producer sarama.AsyncProducer) {
+	errors := producer.Errors()
+	successes := producer.Successes()
+
+	for errors != nil || successes != nil {
+		select {
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			ErrorLogger.Printf("Kafka producer error: %v", err)
+			if isKafkaConnectionError(err.Err) {
+				k.state.lost(k.Connection)
+			}
+			if ack, ok := err.Msg.Metadata.(kafkaDeadLetterAck); ok {
+				ack <- err.Err
+				continue
+			}
+			if k.callback != nil {
+				context, _ := err.Msg.Metadata.(Context)
+				k.callback(err.Msg.Topic, context, err.Err)
+			}
+		case message, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			if ack, ok := message.Metadata.(kafkaDeadLetterAck); ok {
+				ack <- nil
+				continue
+			}
+			if k.callback != nil {
+				context, _ := message.Metadata.(Context)
+				k.callback(message.Topic, context, nil)
+			}
+		}
+	}
+}
+
+func (k *kafkaTransport) Reconnect() {
+	k.state.lost(k.Connection)
+}
+
 func (k *kafkaTransport) Receive(queueName string) {
-	consumer, err := k.consumer.ConsumePartition(queueName, 0, sarama.OffsetNewest)
+	for {
+		lost, ok := k.state.wait()
+		if !ok {
+			return
+		}
+
+		k.consume(queueName, lost)
+	}
+}
+
+//Consumes as a member of the consumer group until the connection is lost
+func (k *kafkaTransport) consume(queueName string, lost <-chan struct{}) {
+	groupId := k.groupId
+	if groupId == "" {
+		groupId = queueName
+	}
+
+	k.mutex.RLock()
+	group, err := sarama.NewConsumerGroupFromClient(groupId, k.client)
+	k.mutex.RUnlock()
+
 	if err != nil {
-		panic(err)
+		ErrorLogger.Printf("Failed to join the Kafka consumer group %v: %v", groupId, err)
+		if isKafkaConnectionError(err) {
+			k.state.lost(k.Connection)
+		}
+
+		select {
+		case <-lost:
+		case <-time.After(kafkaConsumerRetry):
+		}
+		return
 	}
+	defer group.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	go func() {
+		for {
+			select {
+			case err, ok := <-group.Errors():
+				if !ok {
+					return
+				}
+				ErrorLogger.Printf("Kafka consumer error: %v", err)
+				if isKafkaConnectionError(err) {
+					k.state.lost(k.Connection)
+				}
+			case <-lost:
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	//Consume returns on each rebalance, so it has to be called again
+	for ctx.Err() == nil {
+		err := group.Consume(ctx, []string{queueName}, kafkaGroupHandler{k.maxDeliveries, k.sendDeadLetter})
+		if err != nil {
+			ErrorLogger.Printf("Kafka consumer group %v error: %v", groupId, err)
+			if isKafkaConnectionError(err) {
+				k.state.lost(k.Connection)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(kafkaConsumerRetry):
+			}
+		}
+	}
+}
+
+func (kafkaGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (kafkaGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+//The offset of a message is committed only once it has been successfully invoked. A failed invocation is retried
+//with a backoff, the next messages of the partition waiting for it, until the claim is revoked or the message has
+//failed max.deliveries times. It is then sent to the dead-letter topic and committed.
+//A message that cannot be decoded is skipped.
+func (h kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		msg := EmptyContext
+		err := json.Unmarshal(message.Value, &msg)
+		if err != nil {
+			ErrorLogger.Printf("Invalid Kafka message %v/%v/%v skipped: %v", message.Topic, message.Partition, message.Offset, err)
+			session.MarkMessage(message, "")
+			continue
+		}
+		if carrier := kafkaCarrier(message.Headers); carrier != nil {
+			msg.carrier = carrier
+		}
+		InfoLogger.Printf("New Kafka message received: %v", msg)
+
+		b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+		for deliveries := 1; ; deliveries++ {
+			err = invoke(msg)
+			if err == nil {
+				break
+			}
+			ErrorLogger.Printf("Failed to process Kafka message %v/%v/%v: %v", message.Topic, message.Partition, message.Offset, err)
+
+			if h.maxDeliveries > 0 && deliveries >= h.maxDeliveries {
+				if !h.sendDeadLetter(session, message, deliveries) {
+					return nil
+				}
+				break
+			}
+
+			select {
+			case <-time.After(b.next()):
+			case <-session.Context().Done():
+				return nil
+			}
+		}
+
+		session.MarkMessage(message, "")
+	}
+
+	return nil
+}
+
+//Sends a message to the dead-letter topic, retried with a backoff until the claim is revoked (false if so)
+func (h kafkaGroupHandler) sendDeadLetter(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage, deliveries int) bool {
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
 	for {
+		err := h.deadLetter(session.Context(), message, deliveries)
+		if err == nil {
+			ErrorLogger.Printf("Kafka message %v/%v/%v sent to the dead-letter topic after %v deliveries", message.Topic, message.Partition, message.Offset, deliveries)
+			return true
+		}
+		ErrorLogger.Printf("Failed to send Kafka message %v/%v/%v to the dead-letter topic: %v", message.Topic, message.Partition, message.Offset, err)
+
 		select {
-		case err := <-consumer.Errors():
-			ErrorLogger.Printf("Kafka consumer error: %v", err)
-		case message := <-consumer.Messages():
-			msg := EmptyContext
-			json.Unmarshal(message.Value, &msg)
-			InfoLogger.Printf("New Kafka message received: %v", msg)
-			ActorSystem().Invoke(msg)
+		case <-time.After(b.next()):
+		case <-session.Context().Done():
+			return false
 		}
 	}
 }
 
+//The message is sent as received, with its origin and number of deliveries, the broker acknowledgement being awaited
+func (k *kafkaTransport) sendDeadLetter(ctx context.Context, message *sarama.ConsumerMessage, deliveries int) error {
+	topic := k.deadLetter
+	if topic == "" {
+		topic = message.Topic + kafkaDeadLetterSuffix
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(message.Value),
+	}
+	if message.Key != nil {
+		m.Key = sarama.ByteEncoder(message.Key)
+	}
+	if k.headers {
+		for _, h := range message.Headers {
+			m.Headers = append(m.Headers, *h)
+		}
+		m.Headers = append(m.Headers,
+			sarama.RecordHeader{Key: []byte(kafkaHeaderOrigin), Value: []byte(fmt.Sprintf("%v/%v/%v", message.Topic, message.Partition, message.Offset))},
+			sarama.RecordHeader{Key: []byte(kafkaHeaderDeliveries), Value: []byte(strconv.Itoa(deliveries))})
+	}
+
+	k.mutex.RLock()
+	producer := k.producer
+	syncProducer := k.syncProducer
+	k.mutex.RUnlock()
+
+	if syncProducer != nil {
+		_, _, err := syncProducer.SendMessage(m)
+		return err
+	}
+	if producer == nil {
+		return ErrTransportDisconnected
+	}
+
+	ack := make(kafkaDeadLetterAck, 1)
+	m.Metadata = ack
+	err := sendAsync(producer, m)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (k *kafkaTransport) Close() {
-	if err := k.producer.Close(); err != nil {
-		ErrorLogger.Printf("Failed shut access log producer: %v", err)
+	k.state.close()
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if k.producer != nil {
+		if err := k.producer.Close(); err != nil {
+			ErrorLogger.Printf("Failed to close the Kafka producer: %v", err)
+		}
+	}
+	if k.syncProducer != nil {
+		if err := k.syncProducer.Close(); err != nil {
+			ErrorLogger.Printf("Failed to close the Kafka producer: %v", err)
+		}
+	}
+	if k.client != nil {
+		k.client.Close()
 	}
 }
 
 func (k *kafkaTransport) Send(destination string, data []byte) error {
+	return k.SendContext(destination, EmptyContext, data)
+}
+
+//Messages sharing the same key are sent to the same partition.
+//In sync mode, the error returned is the one of the brokers.
+func (k *kafkaTransport) SendContext(destination string, context Context, data []byte) error {
 	InfoLogger.Printf("Sending message to the Kafka destination %v", destination)
-	k.producer.Input() <- &sarama.ProducerMessage{
-		Topic: destination,
-		Value: sarama.StringEncoder(data),
+
+	held, err := k.state.hold(destination, context, data)
+	if held {
+		return err
 	}
 
-	return nil
+	return k.publish(destination, context, data)
 }
 
-func newConsumer(brokerList []string) (sarama.Consumer, error) {
-	config := sarama.NewConfig()
+//The producers are sent to outside of the lock, a stalled producer not blocking the reconnection
+func (k *kafkaTransport) publish(destination string, context Context, data []byte) error {
+	k.mutex.RLock()
+	producer := k.producer
+	syncProducer := k.syncProducer
+	k.mutex.RUnlock()
 
-	config.Producer.RequiredAcks = sarama.WaitForLocal
-	config.Producer.Compression = sarama.CompressionSnappy
-	config.Producer.Flush.Frequency = 15 * time.Millisecond
+	message := k.message(destination, context, data)
 
-	consumer, err := sarama.NewConsumer(brokerList, config)
+	if syncProducer == nil {
+		return sendAsync(producer, message)
+	}
+
+	_, _, err := syncProducer.SendMessage(message)
 	if err != nil {
-		ErrorLogger.Printf("Failed to start sarama consumer: %v", err)
-		return nil, fmt.Errorf("failed to start sarama consumer: %v", err)
+		ErrorLogger.Printf("Failed to write the message to the Kafka destination %v: %v", destination, err)
+		if isKafkaConnectionError(err) {
+			k.state.lost(k.Connection)
+		}
 	}
 
-	return consumer, nil
+	return err
 }
 
-func newProducer(brokerList []string) (sarama.AsyncProducer, error) {
-	config := sarama.NewConfig()
+//The producer copied before a reconnection may have been closed meanwhile
+func sendAsync(producer sarama.AsyncProducer, message *sarama.ProducerMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ErrorLogger.Printf("Failed to write the message to the Kafka destination %v: producer closed", message.Topic)
+			err = ErrTransportDisconnected
+		}
+	}()
 
-	config.Producer.RequiredAcks = sarama.WaitForLocal      // Only wait for the leader to ack
-	config.Producer.Compression = sarama.CompressionSnappy  // Compress messages
-	config.Producer.Flush.Frequency = 15 * time.Millisecond // Flush batches every 500ms
+	producer.Input() <- message
 
-	producer, err := sarama.NewAsyncProducer(brokerList, config)
-	if err != nil {
-		ErrorLogger.Printf("Failed to start sarama producer: %v", err)
-		return nil, fmt.Errorf("failed to start sarama producer: %v", err)
+	return nil
+}
+
+func (k *kafkaTransport) message(destination string, context Context, data []byte) *sarama.ProducerMessage {
+	message := &sarama.ProducerMessage{
+		Topic:    destination,
+		Value:    sarama.StringEncoder(data),
+		Metadata: context,
 	}
 
-	go func() {
-		for err := range producer.Errors() {
-			ErrorLogger.Printf("Failed to write access log entry: %v", err)
+	if key := k.key(context); key != "" {
+		message.Key = sarama.StringEncoder(key)
+	}
+
+	if k.headers && context.MessageType != "" {
+		message.Headers = []sarama.RecordHeader{
+			{Key: []byte(kafkaHeaderMessageType), Value: []byte(context.MessageType)},
+			{Key: []byte(kafkaHeaderCodec), Value: []byte(kafkaCodec)},
 		}
-	}()
+		if context.Sender != nil {
+			message.Headers = append(message.Headers, sarama.RecordHeader{Key: []byte(kafkaHeaderSender), Value: []byte(context.Sender.Name())})
+		}
+		for key, value := range context.carrier {
+			message.Headers = append(message.Headers, sarama.RecordHeader{Key: []byte(kafkaHeaderTracingPrefix + key), Value: []byte(value)})
+		}
+	}
+
+	return message
+}
+
+func kafkaCarrier(headers []*sarama.RecordHeader) opentracing.TextMapCarrier {
+	var carrier opentracing.TextMapCarrier
+
+	for _, h := range headers {
+		key := string(h.Key)
+		if strings.HasPrefix(key, kafkaHeaderTracingPrefix) {
+			if carrier == nil {
+				carrier = opentracing.TextMapCarrier{}
+			}
+			carrier[strings.TrimPrefix(key, kafkaHeaderTracingPrefix)] = string(h.Value)
+		}
+	}
+
+	return carrier
+}
+
+func isKafkaConnectionError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
 
-	return producer, nil
+	return err == sarama.ErrOutOfBrokers || err == sarama.ErrNotConnected || err == sarama.ErrClosedClient || err == io.EOF
 }
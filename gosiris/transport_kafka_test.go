@@ -0,0 +1,212 @@
+package gosiris
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	"sync"
+	"testing"
+	"time"
+)
+
+type account string
+
+func (a account) Key() string {
+	return string(a)
+}
+
+func TestKafkaRecord(t *testing.T) {
+	t.Log("Starting Kafka record test")
+
+	transport := newKafkaTransport().(*kafkaTransport)
+	err := transport.Configure("kafka:9092", nil)
+	if err != nil {
+		t.Fatalf("Configure error: %v", err)
+	}
+
+	sender := newActorRef("sender")
+	context := Context{MessageType: "debit", Data: account("account-42"), Sender: sender, Self: sender, carrier: map[string]string{"x-b3-traceid": "1"}}
+
+	message := transport.message("topic", context, []byte("{}"))
+	key, _ := message.Key.Encode()
+	if string(key) != "account-42" {
+		t.Errorf("Unexpected key %s", key)
+	}
+
+	headers := make(map[string]string)
+	for _, h := range message.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	if headers[kafkaHeaderMessageType] != "debit" || headers[kafkaHeaderSender] != "sender" || headers[kafkaHeaderCodec] != kafkaCodec {
+		t.Errorf("Unexpected headers %v", headers)
+	}
+
+	received := make([]*sarama.RecordHeader, len(message.Headers))
+	for i := range message.Headers {
+		received[i] = &message.Headers[i]
+	}
+	carrier := kafkaCarrier(received)
+	if carrier["x-b3-traceid"] != "1" {
+		t.Errorf("Unexpected carrier %v", carrier)
+	}
+
+	RegisterKeyExtractor("type", func(context Context) string {
+		return context.MessageType
+	})
+	transport.Configure("kafka:9092", map[string]string{KafkaKeyExtractor: "type"})
+	message = transport.message("topic", context, []byte("{}"))
+	key, _ = message.Key.Encode()
+	if string(key) != "debit" {
+		t.Errorf("Unexpected key %s", key)
+	}
+
+	err = transport.Configure("kafka:9092", map[string]string{KafkaKeyExtractor: "unknown"})
+	if err == nil {
+		t.Errorf("Unknown extractor expected to be rejected")
+	}
+}
+
+func TestKafkaProducerMode(t *testing.T) {
+	t.Log("Starting Kafka producer mode test")
+
+	transport := newKafkaTransport().(*kafkaTransport)
+	err := transport.Configure("kafka:9092", map[string]string{KafkaProducerMode: KafkaSync})
+	if err != nil {
+		t.Error(err)
+	}
+	if !transport.sync || !transport.config.Producer.Return.Successes {
+		t.Errorf("Sync producer expected")
+	}
+
+	err = transport.Configure("kafka:9092", map[string]string{KafkaProducerMode: "batch"})
+	if err == nil {
+		t.Errorf("Unknown producer mode expected to be rejected")
+	}
+
+	err = transport.Configure("kafka:9092", map[string]string{KafkaCallback: "unknown"})
+	if err == nil {
+		t.Errorf("Unknown callback expected to be rejected")
+	}
+
+	RegisterKafkaCallback("delivered", func(destination string, context Context, err error) {})
+	transport = newKafkaTransport().(*kafkaTransport)
+	err = transport.Configure("kafka:9092", map[string]string{KafkaCallback: "delivered"})
+	if err != nil || transport.callback == nil || transport.sync {
+		t.Errorf("Async producer with callback expected: %v", err)
+	}
+
+	context := Context{MessageType: "debit", Sender: newActorRef("sender"), Self: newActorRef("sender")}
+	message := transport.message("topic", context, []byte("{}"))
+	if m, ok := message.Metadata.(Context); !ok || m.MessageType != "debit" {
+		t.Errorf("Unexpected metadata %v", message.Metadata)
+	}
+}
+
+//Consumer group session recording the offsets marked
+type kafkaTestSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked []int64
+	mutex  sync.Mutex
+}
+
+func (s *kafkaTestSession) MarkMessage(message *sarama.ConsumerMessage, metadata string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.marked = append(s.marked, message.Offset)
+}
+
+func (s *kafkaTestSession) Context() context.Context {
+	return s.ctx
+}
+
+type kafkaTestClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c kafkaTestClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func TestKafkaConsumeClaim(t *testing.T) {
+	t.Log("Starting Kafka consume claim test")
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	attempts := make(map[string]int)
+	actor := new(Actor).React("deposit", func(context Context) {
+		id := context.Data.(string)
+		attempts[id]++
+		if id == "failing" || (id == "flaky" && attempts[id] == 1) {
+			panic("deposit failed")
+		}
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("kafkaAccount", actor, nil)
+	ref, _ := ActorSystem().ActorOf("kafkaAccount")
+
+	record := func(offset int64, id string) *sarama.ConsumerMessage {
+		value, _ := json.Marshal(Context{MessageType: "deposit", Data: id, Sender: ref, Self: ref})
+		return &sarama.ConsumerMessage{Topic: "accounts", Offset: offset, Value: value}
+	}
+
+	//A failed message is retried before the next ones are marked
+	session := &kafkaTestSession{ctx: context.Background()}
+	claim := kafkaTestClaim{messages: make(chan *sarama.ConsumerMessage, 3)}
+	claim.messages <- record(0, "flaky")
+	claim.messages <- &sarama.ConsumerMessage{Topic: "accounts", Offset: 1, Value: []byte("invalid")}
+	claim.messages <- record(2, "valid")
+	close(claim.messages)
+	kafkaGroupHandler{}.ConsumeClaim(session, claim)
+	if len(session.marked) != 3 || session.marked[0] != 0 || session.marked[2] != 2 {
+		t.Errorf("Unexpected offsets marked %v", session.marked)
+	}
+
+	//A message still failing once the claim is revoked is not marked
+	ctx, cancel := context.WithCancel(context.Background())
+	session = &kafkaTestSession{ctx: ctx}
+	claim = kafkaTestClaim{messages: make(chan *sarama.ConsumerMessage, 2)}
+	claim.messages <- record(3, "failing")
+	claim.messages <- record(4, "valid")
+	time.AfterFunc(300*time.Millisecond, cancel)
+	kafkaGroupHandler{}.ConsumeClaim(session, claim)
+	if len(session.marked) != 0 {
+		t.Errorf("Unexpected offsets marked %v", session.marked)
+	}
+
+	//A message failing max.deliveries times is sent to the dead-letter topic and marked
+	var deadLetters []int64
+	handler := kafkaGroupHandler{2, func(ctx context.Context, message *sarama.ConsumerMessage, deliveries int) error {
+		if deliveries != 2 {
+			t.Errorf("Unexpected deliveries %v", deliveries)
+		}
+		deadLetters = append(deadLetters, message.Offset)
+		return nil
+	}}
+	attempts["failing"] = 0
+	session = &kafkaTestSession{ctx: context.Background()}
+	claim = kafkaTestClaim{messages: make(chan *sarama.ConsumerMessage, 2)}
+	claim.messages <- record(5, "failing")
+	claim.messages <- record(6, "valid")
+	close(claim.messages)
+	handler.ConsumeClaim(session, claim)
+	if attempts["failing"] != 2 || len(deadLetters) != 1 || deadLetters[0] != 5 {
+		t.Errorf("Unexpected dead letters %v after %v attempts", deadLetters, attempts["failing"])
+	}
+	if len(session.marked) != 2 || session.marked[0] != 5 || session.marked[1] != 6 {
+		t.Errorf("Unexpected offsets marked %v", session.marked)
+	}
+
+	transport := newKafkaTransport().(*kafkaTransport)
+	err := transport.Configure("kafka:9092", map[string]string{KafkaMaxDeliveries: "0"})
+	if err == nil {
+		t.Errorf("Invalid maximum deliveries expected to be rejected")
+	}
+	err = transport.Configure("kafka:9092", map[string]string{KafkaMaxDeliveries: "3", KafkaDeadLetter: "accounts.failed"})
+	if err != nil || transport.maxDeliveries != 3 || transport.deadLetter != "accounts.failed" {
+		t.Errorf("Unexpected dead-letter configuration: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var Memory = "memory"
+
+//Options supported by the memory transport, also accepted as url parameters
+const (
+	MemoryLatency = "latency" //Delay before a message is delivered (e.g. 5ms)
+	MemoryReorder = "reorder" //Probability for a message to be overtaken by the next ones
+	MemoryDrop    = "drop"    //Probability for a message to be lost
+	MemoryTopic   = "topic"   //Whether the destinations are topics, each receiver getting every message sent while it receives (default false)
+)
+
+const (
+	memoryQueueSize = 1024
+)
+
+var memoryBrokers = make(map[string]*memoryBroker)
+var memoryBrokersMutex sync.Mutex
+
+//In-process broker simulating queues, each destination being consumed by competing receivers, and topics whose
+//messages are fanned out to the subscription of each receiver
+type memoryBroker struct {
+	queues map[string]chan []byte
+	topics map[string]map[chan []byte]struct{}
+	mutex  sync.Mutex
+}
+
+//Message delivered to its queue once due
+type memoryDelayed struct {
+	due         time.Time
+	destination string
+	data        []byte
+}
+
+//The url is the broker name, optionally followed by the fault injection parameters,
+//e.g. broker?latency=5ms&reorder=0.2&drop=0.1
+type memoryTransport struct {
+	url     string
+	topic   bool
+	broker  *memoryBroker
+	latency time.Duration
+	reorder float64
+	drop    float64
+	random  *rand.Rand
+	delayed []memoryDelayed //Ordered by due time, the messages due at the same time keeping their sending order
+	wakeup  chan struct{}
+	done    chan struct{}
+	mutex   sync.Mutex
+}
+
+func init() {
+	registerTransport(Memory, newMemoryTransport)
+}
+
+func newMemoryTransport() TransportInterface {
+	return &memoryTransport{
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		wakeup: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func memoryBrokerOf(name string) *memoryBroker {
+	memoryBrokersMutex.Lock()
+	defer memoryBrokersMutex.Unlock()
+
+	b, exists := memoryBrokers[name]
+	if !exists {
+		b = &memoryBroker{
+			queues: make(map[string]chan []byte),
+			topics: make(map[string]map[chan []byte]struct{}),
+		}
+		memoryBrokers[name] = b
+	}
+
+	return b
+}
+
+func (b *memoryBroker) queue(destination string) chan []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q, exists := b.queues[destination]
+	if !exists {
+		q = make(chan []byte, memoryQueueSize)
+		b.queues[destination] = q
+	}
+
+	return q
+}
+
+func (b *memoryBroker) subscribe(topic string) chan []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s := make(chan []byte, memoryQueueSize)
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[chan []byte]struct{})
+	}
+	b.topics[topic][s] = struct{}{}
+
+	return s
+}
+
+func (b *memoryBroker) unsubscribe(topic string, s chan []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.topics[topic], s)
+	if len(b.topics[topic]) == 0 {
+		delete(b.topics, topic)
+	}
+}
+
+//A message published to a topic without subscription is lost, a full subscription being reported once the others have received it
+func (b *memoryBroker) publish(destination string, topic bool, data []byte) error {
+	if !topic {
+		select {
+		case b.queue(destination) <- data:
+			return nil
+		default:
+			return fmt.Errorf("memory destination %v full", destination)
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var err error
+	for s := range b.topics[destination] {
+		select {
+		case s <- data:
+		default:
+			err = fmt.Errorf("memory destination %v full", destination)
+		}
+	}
+
+	return err
+}
+
+func (m *memoryTransport) Configure(u string, options map[string]string) error {
+	err := validateTransportOptions(Memory, options, MemoryLatency, MemoryReorder, MemoryDrop, MemoryTopic)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	m.url = parsed.Host + parsed.Path
+
+	merged := make(map[string]string)
+	for k := range parsed.Query() {
+		merged[k] = parsed.Query().Get(k)
+	}
+	for k, v := range options {
+		merged[k] = v
+	}
+
+	if v, exists := merged[MemoryLatency]; exists {
+		m.latency, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, MemoryLatency, err)
+		}
+	}
+	if v, exists := merged[MemoryReorder]; exists {
+		m.reorder, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, MemoryReorder, err)
+		}
+	}
+	if v, exists := merged[MemoryDrop]; exists {
+		m.drop, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, MemoryDrop, err)
+		}
+	}
+	m.topic, err = boolTransportOption(merged, MemoryTopic)
+
+	return err
+}
+
+func (m *memoryTransport) Connection() error {
+	m.broker = memoryBrokerOf(m.url)
+	if m.latency != 0 || m.reorder != 0 {
+		go m.deliverDelayed()
+	}
+
+	InfoLogger.Printf("Connected to the memory broker %v", m.url)
+
+	return nil
+}
+
+func (m *memoryTransport) Receive(destination string) {
+	var q chan []byte
+	if m.topic {
+		q = m.broker.subscribe(destination)
+		defer m.broker.unsubscribe(destination, q)
+	} else {
+		q = m.broker.queue(destination)
+	}
+
+	for {
+		select {
+		case data := <-q:
+			msg := EmptyContext
+			err := json.Unmarshal(data, &msg)
+			if err != nil {
+				ErrorLogger.Printf("Failed to unmarshal memory message: %v", err)
+				continue
+			}
+			InfoLogger.Printf("New memory message received: %v", msg)
+			invoke(msg)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *memoryTransport) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+}
+
+func (m *memoryTransport) Send(destination string, data []byte) error {
+	InfoLogger.Printf("Sending message to the memory destination %v", destination)
+
+	m.mutex.Lock()
+	drop := m.random.Float64() < m.drop
+	delay := m.latency
+	if m.random.Float64() < m.reorder {
+		//A delayed message is overtaken by the next ones
+		delay += time.Duration(m.random.Int63n(int64(m.latency) + int64(time.Millisecond)))
+	}
+	m.mutex.Unlock()
+
+	if drop {
+		InfoLogger.Printf("Message to the memory destination %v dropped", destination)
+		return nil
+	}
+
+	if !m.topic && len(m.broker.queue(destination)) == memoryQueueSize {
+		ErrorLogger.Printf("Memory destination %v full", destination)
+		return fmt.Errorf("memory destination %v full", destination)
+	}
+
+	if delay == 0 {
+		return m.broker.publish(destination, m.topic, data)
+	}
+
+	m.mutex.Lock()
+	due := time.Now().Add(delay)
+	i := sort.Search(len(m.delayed), func(i int) bool {
+		return m.delayed[i].due.After(due)
+	})
+	m.delayed = append(m.delayed, memoryDelayed{})
+	copy(m.delayed[i+1:], m.delayed[i:])
+	m.delayed[i] = memoryDelayed{due, destination, data}
+	m.mutex.Unlock()
+
+	select {
+	case m.wakeup <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+//Delivers the delayed messages in the order they are due, a message due to a full destination being lost
+func (m *memoryTransport) deliverDelayed() {
+	for {
+		var wait <-chan time.Time
+		var timer *time.Timer
+
+		m.mutex.Lock()
+		now := time.Now()
+		for len(m.delayed) != 0 && !m.delayed[0].due.After(now) {
+			message := m.delayed[0]
+			m.delayed = m.delayed[1:]
+
+			if err := m.broker.publish(message.destination, m.topic, message.data); err != nil {
+				ErrorLogger.Printf("Message to the memory destination %v lost: %v", message.destination, err)
+			}
+		}
+		if len(m.delayed) != 0 {
+			timer = time.NewTimer(m.delayed[0].due.Sub(now))
+			wait = timer.C
+		}
+		m.mutex.Unlock()
+
+		select {
+		case <-wait:
+		case <-m.wakeup:
+		case <-m.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package gosiris
+
+import (
+	"github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func startMqttBroker(t *testing.T) (*mqtt.Server, string) {
+	broker := mqtt.New(&mqtt.Options{Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))})
+	broker.AddHook(new(auth.AllowHook), nil)
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "gosiris", Address: "127.0.0.1:0"})
+	err := broker.AddListener(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return broker, "tcp://" + tcp.Address()
+}
+
+func TestMqtt(t *testing.T) {
+	t.Log("Starting MQTT test")
+
+	broker, url := startMqttBroker(t)
+	defer broker.Close()
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	for _, version := range []string{MqttV311, MqttV5} {
+		received := make(chan interface{}, 1)
+		actor := new(Actor).React("context", func(context Context) {
+			context.Self.LogInfo(context, "Received %v", context.Data)
+			received <- context.Data
+		})
+		name := "mqttActor" + version
+		ActorSystem().RegisterActor(name, actor, new(ActorOptions).SetRemote(true).SetRemoteType(Mqtt).SetUrl(url).SetDestination("gosiris/"+name).
+			SetTransportOption(MqttVersion, version).SetTransportOption(MqttQos, "2"))
+		time.Sleep(200 * time.Millisecond)
+
+		actorRef, _ := ActorSystem().ActorOf(name)
+		err := actorRef.Tell(EmptyContext, "context", "hello", actorRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case data := <-received:
+			if data != "hello" {
+				t.Errorf("Unexpected data %v", data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("No message received with MQTT %v", version)
+		}
+		actor.Close()
+	}
+}
+
+func TestMqttOptions(t *testing.T) {
+	t.Log("Starting MQTT options test")
+
+	transport := newMqttTransport()
+	for _, options := range []map[string]string{{MqttQos: "3"}, {MqttVersion: "4"}, {MqttSessionExpiry: "forever"}} {
+		err := transport.Configure("tcp://localhost:1883", options)
+		if err == nil {
+			t.Errorf("Invalid options %v expected to be rejected", options)
+		}
+	}
+
+	if !mqttMatch("gosiris/+/orders/#", "gosiris/eu/orders/42/created") || mqttMatch("gosiris/+", "gosiris/eu/orders") || !mqttMatch("gosiris/eu", "gosiris/eu") {
+		t.Errorf("Unexpected topic matching")
+	}
+}
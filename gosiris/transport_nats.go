@@ -0,0 +1,426 @@
+package gosiris
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Nats = "nats"
+
+//Options supported by the NATS transport (along with the TLS ones)
+const (
+	NatsUser          = "user"           //User authenticated with NatsPassword, the credentials of the url being used otherwise
+	NatsPassword      = "password"       //Password of NatsUser, not published to the registry unlike the url
+	NatsJetStream     = "jetstream"      //true to persist the messages in JetStream and consume them with durable consumers
+	NatsStream        = "stream"         //JetStream stream of the destination, created if missing (default: derived from the destination)
+	NatsQueueGroup    = "queue.group"    //Queue group (and JetStream durable consumer) shared by the receivers (default: derived from the destination)
+	NatsMaxDeliveries = "max.deliveries" //Deliveries of a JetStream message before it is terminated (default 5)
+)
+
+const (
+	natsReplyHeader          = "gosiris-reply-to"
+	natsRequesterExpiry      = time.Minute
+	defaultNatsMaxDeliveries = 5
+)
+
+//The destinations are NATS subjects. Each message carries the inbox of the transport sending it
+//so that a receiver may reply to a sender it does not know (e.g. not registered in the registry).
+type natsTransport struct {
+	url           string
+	tls           *tls.Config
+	user          string
+	password      string
+	jetStream     bool
+	stream        string
+	queueGroup    string
+	maxDeliveries int
+	connection    *nats.Conn
+	js            nats.JetStreamContext
+	inbox         string
+	streams       map[string]bool
+	requesters    map[string]*natsRequester //Requesters registered by the transport, removed once idle
+	expiry        time.Duration
+	done          chan struct{}
+	mutex         sync.Mutex
+	//Distinct from the mutex taken by Close, the requesters being registered along with their connection
+	requestersMutex sync.Mutex
+}
+
+type natsRequester struct {
+	inbox string
+	timer *time.Timer
+}
+
+//Transport of a requester, reached through the inbox of its request
+type natsReplyTransport struct {
+	*natsTransport
+}
+
+func (natsReplyTransport) Receive(string) {}
+
+func (natsReplyTransport) Close() {}
+
+//The replies are published to the inbox with core NATS, even in JetStream mode
+func (r natsReplyTransport) Send(inbox string, data []byte) error {
+	InfoLogger.Printf("Sending reply to the NATS inbox %v", inbox)
+
+	if r.connection == nil {
+		return ErrTransportDisconnected
+	}
+
+	return r.connection.PublishMsg(&nats.Msg{Subject: inbox, Reply: r.inbox, Data: data})
+}
+
+func init() {
+	registerTransport(Nats, newNatsTransport)
+	registerSecretTransportOption(NatsPassword)
+}
+
+func newNatsTransport() TransportInterface {
+	return &natsTransport{
+		streams:       make(map[string]bool),
+		requesters:    make(map[string]*natsRequester),
+		expiry:        natsRequesterExpiry,
+		maxDeliveries: defaultNatsMaxDeliveries,
+		done:          make(chan struct{}),
+	}
+}
+
+func (n *natsTransport) Configure(url string, options map[string]string) error {
+	n.url = url
+
+	err := validateTransportOptions(Nats, options, NatsUser, NatsPassword, NatsJetStream, NatsStream, NatsQueueGroup, NatsMaxDeliveries, TlsCa, TlsCert, TlsKey, TlsInsecure)
+	if err != nil {
+		return err
+	}
+
+	_, user := options[NatsUser]
+	_, password := options[NatsPassword]
+	if user != password {
+		return fmt.Errorf("options %v and %v must be set together", NatsUser, NatsPassword)
+	}
+	n.user = options[NatsUser]
+	n.password = options[NatsPassword]
+
+	n.jetStream, err = boolTransportOption(options, NatsJetStream)
+	if err != nil {
+		return err
+	}
+
+	n.stream = options[NatsStream]
+	n.queueGroup = options[NatsQueueGroup]
+
+	if v, exists := options[NatsMaxDeliveries]; exists {
+		n.maxDeliveries, err = strconv.Atoi(v)
+		if err != nil || n.maxDeliveries < 1 {
+			return fmt.Errorf("invalid value %v for option %v", v, NatsMaxDeliveries)
+		}
+	}
+
+	n.tls, err = tlsConfig(options)
+
+	return err
+}
+
+//The NATS client reconnects by itself and buffers the messages sent in the meantime
+func (n *natsTransport) Connection() error {
+	options := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			ErrorLogger.Printf("Connection to %v lost: %v", n.url, err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			InfoLogger.Printf("Reconnected to %v", n.url)
+		}),
+	}
+	if n.tls != nil {
+		options = append(options, nats.Secure(n.tls))
+	}
+	if n.user != "" {
+		options = append(options, nats.UserInfo(n.user, n.password))
+	}
+
+	c, err := nats.Connect(n.url, options...)
+	if err != nil {
+		ErrorLogger.Printf("Failed to connect to the NATS server %v", n.url)
+		return err
+	}
+
+	var js nats.JetStreamContext
+	if n.jetStream {
+		js, err = c.JetStream()
+		if err != nil {
+			ErrorLogger.Printf("Failed to access JetStream on the NATS server %v", n.url)
+			c.Close()
+			return err
+		}
+	}
+
+	inbox := nats.NewInbox()
+	_, err = c.Subscribe(inbox, n.reply)
+	if err != nil {
+		ErrorLogger.Printf("Failed to subscribe to the NATS inbox %v", inbox)
+		c.Close()
+		return err
+	}
+
+	n.mutex.Lock()
+	n.connection = c
+	n.js = js
+	n.inbox = inbox
+	n.mutex.Unlock()
+
+	InfoLogger.Printf("Connected to %v", n.url)
+
+	return nil
+}
+
+func (n *natsTransport) Receive(destination string) {
+	queueGroup := n.queueGroup
+	if queueGroup == "" {
+		queueGroup = natsName(destination)
+	}
+
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+	for {
+		err := n.subscribe(destination, queueGroup)
+		if err == nil {
+			break
+		}
+
+		ErrorLogger.Printf("Failed to subscribe to the NATS subject %v: %v", destination, err)
+		select {
+		case <-time.After(b.next()):
+		case <-n.done:
+			return
+		}
+	}
+
+	InfoLogger.Printf("Receiving NATS messages from %v", destination)
+
+	//The subscription ends with the connection, a durable consumer being kept in JetStream
+	<-n.done
+}
+
+func (n *natsTransport) subscribe(destination string, queueGroup string) error {
+	if n.connection == nil {
+		return ErrTransportDisconnected
+	}
+
+	if !n.jetStream {
+		_, err := n.connection.QueueSubscribe(destination, queueGroup, n.receive)
+		return err
+	}
+
+	err := n.ensureStream(destination)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.js.QueueSubscribe(destination, queueGroup, n.receive, nats.Durable(queueGroup), nats.ManualAck(), nats.MaxDeliver(n.maxDeliveries))
+	return err
+}
+
+//A JetStream message is acknowledged once invoked, redelivered if its invocation failed
+//and terminated once delivered max.deliveries times
+func (n *natsTransport) receive(msg *nats.Msg) {
+	context := Context{}
+	err := json.Unmarshal(msg.Data, &context)
+	if err != nil {
+		ErrorLogger.Printf("Failed to unmarshal NATS message: %v", err)
+		if n.jetStream {
+			msg.Term()
+		}
+		return
+	}
+
+	reply := msg.Reply
+	if n.jetStream {
+		reply = msg.Header.Get(natsReplyHeader)
+	}
+	if reply != "" {
+		n.registerRequester(context.Sender.Name(), reply)
+	}
+
+	InfoLogger.Printf("New NATS message received: %v", context)
+	err = invoke(context)
+
+	if !n.jetStream {
+		return
+	}
+
+	if err != nil {
+		ErrorLogger.Printf("Failed to process NATS message from %v: %v", msg.Subject, err)
+		if meta, e := msg.Metadata(); e == nil && meta.NumDelivered >= uint64(n.maxDeliveries) {
+			ErrorLogger.Printf("NATS message %v of %v terminated after %v deliveries", meta.Sequence.Stream, msg.Subject, meta.NumDelivered)
+			err = msg.Term()
+		} else {
+			err = msg.Nak()
+		}
+	} else {
+		err = msg.Ack()
+	}
+	if err != nil {
+		ErrorLogger.Printf("Failed to acknowledge NATS message from %v: %v", msg.Subject, err)
+	}
+}
+
+//A requester unknown to this actor system is registered as a remote actor reached through its inbox,
+//then removed once it has not sent any request for a while
+func (n *natsTransport) registerRequester(name string, inbox string) {
+	n.requestersMutex.Lock()
+	defer n.requestersMutex.Unlock()
+
+	if r, exists := n.requesters[name]; exists {
+		r.timer.Reset(n.expiry)
+		if r.inbox == inbox {
+			return
+		}
+		r.inbox = inbox
+	} else if _, err := ActorSystem().actor(name); err == nil {
+		return
+	} else {
+		r := &natsRequester{inbox: inbox}
+		r.timer = time.AfterFunc(n.expiry, func() {
+			n.expireRequester(name, r)
+		})
+		n.requesters[name] = r
+	}
+
+	actor := Actor{}
+	actor.setName(name)
+
+	setRemoteConnection(name, natsReplyTransport{n})
+	ActorSystem().setActor(name, actorAssociation{newActorRef(name), &actor,
+		new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(n.url).SetDestination(inbox)})
+
+	InfoLogger.Printf("Requester %v reachable through the NATS inbox %v", name, inbox)
+}
+
+//The actor is only removed if still the requester reached through its inbox, e.g. not registered meanwhile
+func (n *natsTransport) expireRequester(name string, r *natsRequester) {
+	n.requestersMutex.Lock()
+	defer n.requestersMutex.Unlock()
+
+	if n.requesters[name] != r {
+		return
+	}
+	delete(n.requesters, name)
+
+	a, err := ActorSystem().actor(name)
+	if err != nil || a.options == nil || a.options.RemoteType() != Nats || a.options.Destination() != r.inbox {
+		InfoLogger.Printf("Requester %v expired, actor %v kept", name, name)
+		return
+	}
+	if c, err := RemoteConnection(name); err == nil {
+		if t, ok := c.(natsReplyTransport); ok && t.natsTransport == n {
+			DeleteRemoteActorConnection(name)
+		}
+	}
+	ActorSystem().deleteActor(name)
+
+	InfoLogger.Printf("Requester %v expired", name)
+}
+
+//Replies are addressed to the actors of this system, the local ones being fed through their mailbox
+func (n *natsTransport) reply(msg *nats.Msg) {
+	context := Context{}
+	err := json.Unmarshal(msg.Data, &context)
+	if err != nil {
+		ErrorLogger.Printf("Failed to unmarshal NATS reply: %v", err)
+		return
+	}
+
+	InfoLogger.Printf("New NATS reply received: %v", context)
+
+	association, err := ActorSystem().actor(context.Self.Name())
+	if err == nil && !association.options.Remote() && association.actor.getDataChan() != nil {
+		association.actor.getDataChan() <- context
+		return
+	}
+
+	invoke(context)
+}
+
+func (n *natsTransport) ensureStream(subject string) error {
+	name := n.stream
+	if name == "" {
+		name = natsName(subject)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.streams[name] {
+		return nil
+	}
+
+	_, err := n.js.StreamInfo(name)
+	if err == nats.ErrStreamNotFound {
+		InfoLogger.Printf("Creating the JetStream stream %v for %v", name, subject)
+		_, err = n.js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{subject}})
+	}
+	if err != nil {
+		return err
+	}
+
+	n.streams[name] = true
+	return nil
+}
+
+func (n *natsTransport) Close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	select {
+	case <-n.done:
+		return
+	default:
+		close(n.done)
+	}
+
+	if n.connection != nil {
+		n.connection.Close()
+	}
+}
+
+func (n *natsTransport) Send(destination string, data []byte) error {
+	InfoLogger.Printf("Sending message to the NATS subject %v", destination)
+
+	if n.connection == nil {
+		return ErrTransportDisconnected
+	}
+
+	if !n.jetStream {
+		return n.connection.PublishMsg(&nats.Msg{Subject: destination, Reply: n.inbox, Data: data})
+	}
+
+	err := n.ensureStream(destination)
+	if err != nil {
+		ErrorLogger.Printf("Failed to declare the JetStream stream of %v: %v", destination, err)
+		return err
+	}
+
+	msg := nats.NewMsg(destination)
+	msg.Data = data
+	msg.Header.Set(natsReplyHeader, n.inbox)
+
+	_, err = n.js.PublishMsg(msg)
+	if err != nil {
+		ErrorLogger.Printf("Failed to publish the message to the JetStream subject %v: %v", destination, err)
+	}
+
+	return err
+}
+
+//Stream and consumer names cannot contain the subject delimiters and wildcards
+func natsName(subject string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(subject)
+}
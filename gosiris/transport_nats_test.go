@@ -0,0 +1,237 @@
+package gosiris
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startNatsServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+
+	return s
+}
+
+func TestNats(t *testing.T) {
+	t.Log("Starting NATS test")
+
+	s := startNatsServer(t)
+	defer s.Shutdown()
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	echo := new(Actor).React("ping", func(context Context) {
+		context.Self.LogInfo(context, "Received %v", context.Data)
+		context.Sender.Tell(EmptyContext, "pong", context.Data, context.Self)
+	})
+	defer echo.Close()
+	ActorSystem().RegisterActor("natsEcho", echo, new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(s.ClientURL()).SetDestination("gosiris.echo"))
+
+	replies := make(chan Context, 1)
+	requester := new(Actor).React("pong", func(context Context) {
+		replies <- context
+	})
+	defer requester.Close()
+	ActorSystem().RegisterActor("natsRequester", requester, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	echoRef, _ := ActorSystem().ActorOf("natsEcho")
+	requesterRef, _ := ActorSystem().ActorOf("natsRequester")
+	echoRef.Tell(EmptyContext, "ping", "hello", requesterRef)
+
+	select {
+	case reply := <-replies:
+		if reply.Data != "hello" || reply.Sender.Name() != "natsEcho" {
+			t.Errorf("Unexpected reply %v", reply)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No reply received")
+	}
+
+	//A requester unknown to the actor system is replied through its inbox
+	c, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	transport, _ := RemoteConnection("natsEcho")
+	n := transport.(*natsTransport)
+	n.requestersMutex.Lock()
+	n.expiry = 200 * time.Millisecond
+	n.requestersMutex.Unlock()
+
+	inbox := nats.NewInbox()
+	sub, _ := c.SubscribeSync(inbox)
+	request, _ := json.Marshal(Context{MessageType: "ping", Data: "outside", Sender: newActorRef("natsOutsider"), Self: echoRef})
+	c.PublishRequest("gosiris.echo", inbox, request)
+
+	msg, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]interface{})
+	json.Unmarshal(msg.Data, &m)
+	if m[jsonMessageType] != "pong" || m[jsonSelf] != "natsOutsider" || m[jsonData] != "outside" {
+		t.Errorf("Unexpected reply %v", m)
+	}
+
+	//The requester is removed once idle
+	for i := 0; ; i++ {
+		if _, err := ActorSystem().actor("natsOutsider"); err != nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Requester not expired")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	//An actor registered meanwhile under the name of the requester is kept
+	request, _ = json.Marshal(Context{MessageType: "ping", Data: "outside", Sender: newActorRef("natsShadowed"), Self: echoRef})
+	c.PublishRequest("gosiris.echo", inbox, request)
+	_, err = sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowed := new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(s.ClientURL()).SetDestination("gosiris.shadowed")
+	ActorSystem().setActor("natsShadowed", actorAssociation{newActorRef("natsShadowed"), &Actor{}, shadowed})
+	defer ActorSystem().deleteActor("natsShadowed")
+
+	time.Sleep(500 * time.Millisecond)
+	a, err := ActorSystem().actor("natsShadowed")
+	if err != nil || a.options.Destination() != "gosiris.shadowed" {
+		t.Errorf("Actor registered meanwhile removed with the requester: %v", err)
+	}
+}
+
+func TestNatsJetStream(t *testing.T) {
+	t.Log("Starting NATS JetStream test")
+
+	s := startNatsServer(t)
+	defer s.Shutdown()
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	deliveries := make(chan interface{}, 2)
+	var count int32
+	actor := new(Actor).React("context", func(context Context) {
+		deliveries <- context.Data
+		if atomic.AddInt32(&count, 1) == 1 {
+			panic("failure during the first delivery")
+		}
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("natsDurable", actor, new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(s.ClientURL()).SetDestination("gosiris.durable").
+		SetTransportOption(NatsJetStream, "true"))
+	time.Sleep(100 * time.Millisecond)
+
+	actorRef, _ := ActorSystem().ActorOf("natsDurable")
+	err := actorRef.Tell(EmptyContext, "context", "hello", actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-deliveries:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Message expected to be redelivered once, got %v deliveries", i)
+		}
+	}
+
+	//A message failing max.deliveries times is terminated
+	var poisoned int32
+	poison := new(Actor).React("context", func(context Context) {
+		atomic.AddInt32(&poisoned, 1)
+		panic("poison message")
+	})
+	defer poison.Close()
+	ActorSystem().RegisterActor("natsPoison", poison, new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(s.ClientURL()).SetDestination("gosiris.poison").
+		SetTransportOption(NatsJetStream, "true").SetTransportOption(NatsMaxDeliveries, "2"))
+	time.Sleep(100 * time.Millisecond)
+
+	poisonRef, _ := ActorSystem().ActorOf("natsPoison")
+	err = poisonRef.Tell(EmptyContext, "context", "poison", poisonRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if n := atomic.LoadInt32(&poisoned); n != 2 {
+		t.Errorf("Message expected to be delivered twice, got %v deliveries", n)
+	}
+
+	//A requester outside of the actor system is replied through its inbox, without JetStream stream
+	echo := new(Actor).React("ping", func(context Context) {
+		context.Sender.Tell(EmptyContext, "pong", context.Data, context.Self)
+	})
+	defer echo.Close()
+	ActorSystem().RegisterActor("natsDurableEcho", echo, new(ActorOptions).SetRemote(true).SetRemoteType(Nats).SetUrl(s.ClientURL()).SetDestination("gosiris.durableEcho").
+		SetTransportOption(NatsJetStream, "true"))
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	js, _ := c.JetStream()
+
+	inbox := nats.NewInbox()
+	sub, _ := c.SubscribeSync(inbox)
+	echoRef, _ := ActorSystem().ActorOf("natsDurableEcho")
+	request := nats.NewMsg("gosiris.durableEcho")
+	request.Data, _ = json.Marshal(Context{MessageType: "ping", Data: "durable", Sender: newActorRef("natsDurableOutsider"), Self: echoRef})
+	request.Header.Set(natsReplyHeader, inbox)
+	_, err = js.PublishMsg(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sub.NextMsg(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for name := range js.StreamNames() {
+		if strings.HasPrefix(name, "_INBOX") {
+			t.Errorf("Stream %v created for a reply", name)
+		}
+	}
+}
+
+func TestNatsOptions(t *testing.T) {
+	t.Log("Starting NATS options test")
+
+	transport := newNatsTransport()
+	err := transport.Configure("nats://localhost:4222", map[string]string{NatsJetStream: "yes"})
+	if err == nil {
+		t.Errorf("Invalid option value expected to be rejected")
+	}
+
+	err = transport.Configure("nats://localhost:4222", map[string]string{NatsPassword: "secret"})
+	if err == nil {
+		t.Errorf("Password without user expected to be rejected")
+	}
+
+	err = transport.Configure("nats://localhost:4222", map[string]string{NatsMaxDeliveries: "0"})
+	if err == nil {
+		t.Errorf("Invalid maximum deliveries expected to be rejected")
+	}
+
+	if natsName("orders.*.eu") != "orders___eu" {
+		t.Errorf("Unexpected name %v", natsName("orders.*.eu"))
+	}
+}
@@ -0,0 +1,393 @@
+package gosiris
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var Redis = "redis"
+
+//Options supported by the Redis Streams transport (along with the TLS ones)
+const (
+	RedisPassword         = "password"           //Password of the user of the url, not published to the registry unlike the url
+	RedisGroup            = "group"              //Consumer group shared by the receivers (default: the destination)
+	RedisConsumer         = "consumer"           //Name of the consumer within its group (default: hostname-pid-n, unique per transport)
+	RedisMaxLen           = "max.len"            //Approximate maximum length of the streams written to (default 0: not trimmed)
+	RedisClaimIdle        = "claim.idle"         //Idle time after which the pending messages of a consumer are reclaimed (default 30s)
+	RedisMaxDeliveries    = "max.deliveries"     //Deliveries of a message before it is moved to the dead-letter stream (default 5)
+	RedisDeadLetterStream = "dead.letter.stream" //Stream receiving the messages delivered max.deliveries times (default: the destination followed by :dead)
+)
+
+const (
+	redisDataField            = "data"
+	redisStreamField          = "stream"
+	redisIdField              = "id"
+	redisDeliveriesField      = "deliveries"
+	redisDeadLetterSuffix     = ":dead"
+	redisBlock                = time.Second
+	redisCount                = 16
+	defaultRedisClaimIdle     = 30 * time.Second
+	defaultRedisMaxDeliveries = 5
+)
+
+var redisConsumerCounter uint64
+
+//The destinations are streams consumed through consumer groups.
+//A message is acknowledged once invoked, the pending ones being reclaimed from the crashed consumers.
+//A message still failing after max.deliveries deliveries is moved to a dead-letter stream.
+type redisTransport struct {
+	options          *redis.Options
+	group            string
+	consumer         string
+	maxLen           int64
+	claimIdle        time.Duration
+	maxDeliveries    int64
+	deadLetterStream string
+	client           *redis.Client
+	ctx              context.Context
+	cancel           context.CancelFunc
+	mutex            sync.Mutex
+}
+
+func init() {
+	registerTransport(Redis, newRedisTransport)
+	registerSecretTransportOption(RedisPassword)
+}
+
+func newRedisTransport() TransportInterface {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &redisTransport{
+		claimIdle:     defaultRedisClaimIdle,
+		maxDeliveries: defaultRedisMaxDeliveries,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+func (r *redisTransport) Configure(url string, options map[string]string) error {
+	err := validateTransportOptions(Redis, options, RedisPassword, RedisGroup, RedisConsumer, RedisMaxLen, RedisClaimIdle, RedisMaxDeliveries, RedisDeadLetterStream, TlsCa, TlsCert, TlsKey, TlsInsecure)
+	if err != nil {
+		return err
+	}
+
+	r.options, err = redis.ParseURL(url)
+	if err != nil {
+		return fmt.Errorf("invalid Redis url %v: %v", url, err)
+	}
+
+	var t *tls.Config
+	t, err = tlsConfig(options)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		r.options.TLSConfig = t
+	}
+	if password, exists := options[RedisPassword]; exists {
+		r.options.Password = password
+	}
+
+	r.group = options[RedisGroup]
+
+	r.consumer = options[RedisConsumer]
+	if r.consumer == "" {
+		hostname, _ := os.Hostname()
+		r.consumer = fmt.Sprintf("%v-%v-%v", hostname, os.Getpid(), atomic.AddUint64(&redisConsumerCounter, 1))
+	}
+
+	if v, exists := options[RedisMaxLen]; exists {
+		r.maxLen, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, RedisMaxLen, err)
+		}
+	}
+
+	if v, exists := options[RedisClaimIdle]; exists {
+		r.claimIdle, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, RedisClaimIdle, err)
+		}
+	}
+
+	if v, exists := options[RedisMaxDeliveries]; exists {
+		r.maxDeliveries, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || r.maxDeliveries < 1 {
+			return fmt.Errorf("invalid value %v for option %v", v, RedisMaxDeliveries)
+		}
+	}
+
+	r.deadLetterStream = options[RedisDeadLetterStream]
+
+	return nil
+}
+
+//The Redis client connects lazily and reconnects on the next command if the connection is lost
+func (r *redisTransport) Connection() error {
+	r.client = redis.NewClient(r.options)
+
+	err := r.client.Ping(r.ctx).Err()
+	if err != nil {
+		ErrorLogger.Printf("Failed to connect to the Redis server %v: %v", r.options.Addr, err)
+		return err
+	}
+
+	InfoLogger.Printf("Connected to %v", r.options.Addr)
+
+	return nil
+}
+
+func (r *redisTransport) Receive(stream string) {
+	group := r.group
+	if group == "" {
+		group = stream
+	}
+
+	b := backoff{initial: defaultReconnectInitial, max: defaultReconnectMax}
+	for {
+		err := r.createGroup(stream, group)
+		if err == nil {
+			break
+		}
+		if r.sleep(&b, err) {
+			return
+		}
+	}
+
+	InfoLogger.Printf("Receiving Redis messages from %v", stream)
+
+	claimed := time.Time{}
+	for {
+		var err error
+		if time.Since(claimed) >= r.claimIdle/2 {
+			err = r.claim(stream, group)
+			claimed = time.Now()
+		}
+
+		if err == nil {
+			err = r.read(stream, group)
+		}
+
+		if r.sleep(&b, err) {
+			return
+		}
+	}
+}
+
+//Returns true once the transport is closed, waits before retrying if err is not nil
+func (r *redisTransport) sleep(b *backoff, err error) bool {
+	if r.ctx.Err() != nil {
+		return true
+	}
+
+	if err == nil {
+		b.reset()
+		return false
+	}
+
+	d := b.next()
+	ErrorLogger.Printf("Redis error, retrying in %v: %v", d, err)
+
+	select {
+	case <-time.After(d):
+		return false
+	case <-r.ctx.Done():
+		return true
+	}
+}
+
+func (r *redisTransport) createGroup(stream string, group string) error {
+	err := r.client.XGroupCreateMkStream(r.ctx, stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	return nil
+}
+
+func (r *redisTransport) read(stream string, group string) error {
+	streams, err := r.client.XReadGroup(r.ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: r.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    redisCount,
+		Block:    redisBlock,
+	}).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range streams {
+		for _, m := range s.Messages {
+			r.deliver(stream, group, m)
+		}
+	}
+
+	return nil
+}
+
+//Takes over the messages left pending by a consumer for more than claimIdle
+func (r *redisTransport) claim(stream string, group string) error {
+	start := "0-0"
+	for {
+		messages, next, err := r.client.XAutoClaim(r.ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: r.consumer,
+			MinIdle:  r.claimIdle,
+			Start:    start,
+			Count:    redisCount,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		deliveries, err := r.deliveries(stream, group, messages)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range messages {
+			if deliveries[m.ID] > r.maxDeliveries {
+				r.deadLetter(stream, group, m, deliveries[m.ID]-1)
+				continue
+			}
+
+			InfoLogger.Printf("Redis message %v of %v reclaimed by %v", m.ID, stream, r.consumer)
+			r.deliver(stream, group, m)
+		}
+
+		if next == "0-0" || next == "" {
+			return nil
+		}
+		start = next
+	}
+}
+
+//Returns the number of deliveries of the messages claimed, the claim included. Each message is queried by its own id,
+//an id range possibly including messages pending for other consumers or acknowledged meanwhile.
+func (r *redisTransport) deliveries(stream string, group string, messages []redis.XMessage) (map[string]int64, error) {
+	deliveries := make(map[string]int64)
+	if len(messages) == 0 {
+		return deliveries, nil
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.XPendingExtCmd, len(messages))
+	for i, m := range messages {
+		cmds[i] = pipe.XPendingExt(r.ctx, &redis.XPendingExtArgs{
+			Stream:   stream,
+			Group:    group,
+			Start:    m.ID,
+			End:      m.ID,
+			Count:    1,
+			Consumer: r.consumer,
+		})
+	}
+	_, err := pipe.Exec(r.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		for _, p := range cmd.Val() {
+			deliveries[p.ID] = p.RetryCount
+		}
+	}
+
+	return deliveries, nil
+}
+
+//Moves a message to the dead-letter stream, along with its origin
+func (r *redisTransport) deadLetter(stream string, group string, m redis.XMessage, deliveries int64) {
+	deadLetterStream := r.deadLetterStream
+	if deadLetterStream == "" {
+		deadLetterStream = stream + redisDeadLetterSuffix
+	}
+
+	err := r.client.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: deadLetterStream,
+		Values: map[string]interface{}{
+			redisDataField:       m.Values[redisDataField],
+			redisStreamField:     stream,
+			redisIdField:         m.ID,
+			redisDeliveriesField: deliveries,
+		},
+	}).Err()
+	if err != nil {
+		ErrorLogger.Printf("Failed to move Redis message %v of %v to %v: %v", m.ID, stream, deadLetterStream, err)
+		return
+	}
+
+	ErrorLogger.Printf("Redis message %v of %v moved to %v after %v deliveries", m.ID, stream, deadLetterStream, deliveries)
+
+	err = r.client.XAck(r.ctx, stream, group, m.ID).Err()
+	if err != nil {
+		ErrorLogger.Printf("Failed to acknowledge Redis message %v of %v: %v", m.ID, stream, err)
+	}
+}
+
+//A message whose invocation failed stays pending until it is reclaimed
+func (r *redisTransport) deliver(stream string, group string, m redis.XMessage) {
+	data, _ := m.Values[redisDataField].(string)
+
+	msg := Context{}
+	err := json.Unmarshal([]byte(data), &msg)
+	if err != nil {
+		ErrorLogger.Printf("Failed to unmarshal Redis message %v, discarding it: %v", m.ID, err)
+	} else {
+		InfoLogger.Printf("New Redis message received: %v", msg)
+		err = invoke(msg)
+		if err != nil {
+			ErrorLogger.Printf("Failed to process Redis message %v of %v: %v", m.ID, stream, err)
+			return
+		}
+	}
+
+	err = r.client.XAck(r.ctx, stream, group, m.ID).Err()
+	if err != nil {
+		ErrorLogger.Printf("Failed to acknowledge Redis message %v of %v: %v", m.ID, stream, err)
+	}
+}
+
+func (r *redisTransport) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.cancel()
+
+	if r.client != nil {
+		r.client.Close()
+	}
+}
+
+func (r *redisTransport) Send(destination string, data []byte) error {
+	InfoLogger.Printf("Sending message to the Redis stream %v", destination)
+
+	err := r.client.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: destination,
+		MaxLen: r.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{redisDataField: data},
+	}).Err()
+	if err != nil {
+		ErrorLogger.Printf("Failed to add the message to the Redis stream %v: %v", destination, err)
+	}
+
+	return err
+}
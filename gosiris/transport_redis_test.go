@@ -0,0 +1,198 @@
+package gosiris
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRedis(t *testing.T) {
+	t.Log("Starting Redis test")
+
+	s := miniredis.RunT(t)
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	deliveries := make(chan interface{}, 2)
+	var count int32
+	actor := new(Actor).React("context", func(context Context) {
+		deliveries <- context.Data
+		if atomic.AddInt32(&count, 1) == 1 {
+			panic("failure during the first delivery")
+		}
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("redisActor", actor, new(ActorOptions).SetRemote(true).SetRemoteType(Redis).SetUrl("redis://"+s.Addr()).SetDestination("redisStream").
+		SetTransportOption(RedisClaimIdle, "100ms"))
+	time.Sleep(100 * time.Millisecond)
+
+	actorRef, _ := ActorSystem().ActorOf("redisActor")
+	err := actorRef.Tell(EmptyContext, "context", "hello", actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The failed message stays pending until it is reclaimed
+	for i := 0; i < 2; i++ {
+		select {
+		case <-deliveries:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Message expected to be reclaimed once, got %v deliveries", i)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+	pending, err := client.XPending(context.Background(), "redisStream", "redisStream").Result()
+	if err != nil || pending.Count != 0 {
+		t.Errorf("No pending message expected: %v %v", pending, err)
+	}
+}
+
+func TestRedisDeadLetter(t *testing.T) {
+	t.Log("Starting Redis dead letter test")
+
+	s := miniredis.RunT(t)
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	var count int32
+	actor := new(Actor).React("context", func(context Context) {
+		atomic.AddInt32(&count, 1)
+		panic("failure of every delivery")
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("redisPoisoned", actor, new(ActorOptions).SetRemote(true).SetRemoteType(Redis).SetUrl("redis://"+s.Addr()).SetDestination("poisonedStream").
+		SetTransportOption(RedisClaimIdle, "100ms").SetTransportOption(RedisMaxDeliveries, "2"))
+	time.Sleep(100 * time.Millisecond)
+
+	actorRef, _ := ActorSystem().ActorOf("redisPoisoned")
+	actorRef.Tell(EmptyContext, "context", "poison", actorRef)
+
+	//The message is moved to the dead-letter stream once delivered max.deliveries times
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+	for i := 0; ; i++ {
+		length, _ := client.XLen(context.Background(), "poisonedStream:dead").Result()
+		if length == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Message not dead-lettered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&count); n != 2 {
+		t.Errorf("Message delivered %v times instead of 2", n)
+	}
+	pending, err := client.XPending(context.Background(), "poisonedStream", "poisonedStream").Result()
+	if err != nil || pending.Count != 0 {
+		t.Errorf("No pending message expected: %v %v", pending, err)
+	}
+}
+
+func TestRedisTrimming(t *testing.T) {
+	t.Log("Starting Redis trimming test")
+
+	s := miniredis.RunT(t)
+
+	transport := newRedisTransport()
+	err := transport.Configure("redis://"+s.Addr(), map[string]string{RedisMaxLen: "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.Connection()
+	defer transport.Close()
+
+	for i := 0; i < 20; i++ {
+		transport.Send("trimmed", []byte("{}"))
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+	length, _ := client.XLen(context.Background(), "trimmed").Result()
+	if length > 5 {
+		t.Errorf("Stream expected to be trimmed, got %v messages", length)
+	}
+
+	err = transport.Configure("redis://"+s.Addr(), map[string]string{RedisClaimIdle: "soon"})
+	if err == nil {
+		t.Errorf("Invalid option value expected to be rejected")
+	}
+}
+
+func TestRedisDeliveries(t *testing.T) {
+	t.Log("Starting Redis deliveries test")
+
+	s := miniredis.RunT(t)
+
+	transport := newRedisTransport()
+	err := transport.Configure("redis://"+s.Addr(), map[string]string{RedisConsumer: "claimer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.Connection()
+	defer transport.Close()
+	r := transport.(*redisTransport)
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+	client.XGroupCreateMkStream(ctx, "claimed", "claimed", "0")
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, _ := client.XAdd(ctx, &redis.XAddArgs{Stream: "claimed", Values: map[string]interface{}{redisDataField: "{}"}}).Result()
+		ids = append(ids, id)
+	}
+
+	//The second message is already pending for the claimer, the first and the last ones being claimed from another consumer
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "claimed", Consumer: "other", Streams: []string{"claimed", ">"}, Count: 1})
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "claimed", Consumer: "claimer", Streams: []string{"claimed", ">"}, Count: 1})
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "claimed", Consumer: "other", Streams: []string{"claimed", ">"}, Count: 1})
+	claimed, err := client.XClaim(ctx, &redis.XClaimArgs{Stream: "claimed", Group: "claimed", Consumer: "claimer", Messages: []string{ids[0], ids[2]}}).Result()
+	if err != nil || len(claimed) != 2 {
+		t.Fatalf("Messages not claimed: %v %v", claimed, err)
+	}
+
+	deliveries, err := r.deliveries("claimed", "claimed", claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[ids[0]] != 2 || deliveries[ids[2]] != 2 {
+		t.Errorf("Unexpected deliveries %v", deliveries)
+	}
+}
+
+func TestRedisPassword(t *testing.T) {
+	t.Log("Starting Redis password test")
+
+	s := miniredis.RunT(t)
+	s.RequireAuth("secret")
+
+	//The password is set apart from the url
+	transport := newRedisTransport()
+	err := transport.Configure("redis://"+s.Addr(), map[string]string{RedisPassword: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.Connection()
+	if err != nil {
+		t.Errorf("Failed to authenticate: %v", err)
+	}
+	transport.Close()
+
+	transport = newRedisTransport()
+	transport.Configure("redis://"+s.Addr(), nil)
+	err = transport.Connection()
+	if err == nil {
+		t.Errorf("Connection without password expected to be rejected")
+	}
+	transport.Close()
+}
@@ -0,0 +1,505 @@
+package gosiris
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var Unix = "unix"
+var SharedMemory = "shm"
+
+//Options supported by the Unix domain socket and shared memory transports
+const (
+	UnixMaxFrame     = "max.frame"     //Maximum size of a message in bytes (default 64MB)
+	UnixSharedMemory = "shared.memory" //Size in bytes from which a message is passed through a shared memory segment (default: never with unix, always with shm)
+)
+
+const (
+	unixHeaderSize      = 8
+	unixSegmentFlag     = 1 << 31 //Set in the data length of a frame carrying the name of a segment instead of the data
+	unixSegmentPattern  = "gosiris-*.seg"
+	unixSegmentPrefix   = "gosiris-"
+	unixSharedMemoryDir = "/dev/shm"
+	defaultUnixMaxFrame = 64 << 20
+)
+
+//Each socket is served once per process, whatever the number of destinations it serves.
+//A frame is made of the destination and data lengths (uint32, big endian) followed by the destination and the data.
+//The header, the destination and the data are written with a single writev so that the data are never copied,
+//the receiver acknowledging each frame with a length prefixed error (empty once posted to the mailbox of its destination).
+//A message passed through shared memory is written to a segment, a file of the memory backed /dev/shm (or of the
+//temporary directory elsewhere) mapped by the receiver, the frame only carrying the name of the segment removed by the sender
+//once acknowledged.
+var unixServers = make(map[string]*unixServer)
+var unixServersMutex sync.Mutex
+
+type unixServer struct {
+	path         string
+	listener     net.Listener
+	maxFrame     uint32
+	destinations map[string]int
+	mailboxes    map[string]*remoteMailbox
+	connections  map[net.Conn]struct{}
+	closed       bool
+	mutex        sync.Mutex
+}
+
+//The url is the path of the socket, e.g. unix:///var/run/gosiris.sock or /var/run/gosiris.sock
+//The shm transport is the same transport, passing every message through shared memory by default.
+type unixTransport struct {
+	path       string
+	maxFrame   uint32
+	segment    int64 //Size from which a message is passed through shared memory, -1 if never
+	connection net.Conn
+	reader     *bufio.Reader
+	done       chan struct{}
+	mutex      sync.Mutex
+}
+
+func init() {
+	registerTransport(Unix, newUnixTransport)
+	registerTransport(SharedMemory, newSharedMemoryTransport)
+}
+
+func newUnixTransport() TransportInterface {
+	return &unixTransport{
+		maxFrame: defaultUnixMaxFrame,
+		segment:  -1,
+		done:     make(chan struct{}),
+	}
+}
+
+func newSharedMemoryTransport() TransportInterface {
+	u := newUnixTransport().(*unixTransport)
+	u.segment = 0
+
+	return u
+}
+
+func (u *unixTransport) Configure(rawurl string, options map[string]string) error {
+	err := validateTransportOptions(Unix, options, UnixMaxFrame, UnixSharedMemory)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid socket url %v: %v", rawurl, err)
+	}
+	if parsed.Scheme == Unix || parsed.Scheme == SharedMemory {
+		u.path = parsed.Host + parsed.Path
+	} else {
+		u.path = rawurl
+	}
+
+	if v, exists := options[UnixMaxFrame]; exists {
+		max, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid value %v for option %v: %v", v, UnixMaxFrame, err)
+		}
+		u.maxFrame = uint32(max)
+	}
+
+	if v, exists := options[UnixSharedMemory]; exists {
+		u.segment, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || u.segment < 0 {
+			return fmt.Errorf("invalid value %v for option %v", v, UnixSharedMemory)
+		}
+	}
+
+	return nil
+}
+
+//The socket is dialed on the first message as it may not be served yet
+func (u *unixTransport) Connection() error {
+	InfoLogger.Printf("Unix domain socket transport ready for %v", u.path)
+
+	return nil
+}
+
+func (u *unixTransport) Receive(destination string) {
+	s, err := startUnixServer(u.path, u.maxFrame, destination)
+	if err != nil {
+		ErrorLogger.Printf("Failed to listen on the socket %v: %v", u.path, err)
+		return
+	}
+
+	<-u.done
+	s.release(destination)
+}
+
+func (u *unixTransport) Close() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.closeConnection()
+	select {
+	case <-u.done:
+	default:
+		close(u.done)
+	}
+}
+
+func (u *unixTransport) Send(destination string, data []byte) error {
+	InfoLogger.Printf("Sending message to the Unix domain socket destination %v", destination)
+
+	if uint64(len(data)) > uint64(u.maxFrame) {
+		return fmt.Errorf("message to %v exceeds the maximum frame size of %v bytes", destination, u.maxFrame)
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.connection == nil {
+		c, err := net.Dial("unix", u.path)
+		if err != nil {
+			ErrorLogger.Printf("Failed to connect to the socket %v: %v", u.path, err)
+			return err
+		}
+		u.connection = c
+		u.reader = bufio.NewReader(c)
+	}
+
+	segment := u.segment >= 0 && int64(len(data)) >= u.segment
+	if segment {
+		name, err := writeUnixSegment(data)
+		if err != nil {
+			ErrorLogger.Printf("Failed to write the shared memory segment of %v: %v", destination, err)
+			return err
+		}
+		defer os.Remove(filepath.Join(unixSegmentDir(), name))
+		data = []byte(name)
+	}
+
+	err := writeUnixFrame(u.connection, []byte(destination), data, segment)
+	if err != nil {
+		ErrorLogger.Printf("Error while sending a message to the Unix domain socket destination %v: %v", destination, err)
+		u.closeConnection()
+		return err
+	}
+
+	ack, err := readUnixBlock(u.reader, u.maxFrame)
+	if err != nil {
+		ErrorLogger.Printf("Error while waiting for the acknowledgement of %v: %v", destination, err)
+		u.closeConnection()
+		return err
+	}
+
+	if len(ack) != 0 {
+		return fmt.Errorf("unix delivery error to %v: %s", destination, ack)
+	}
+
+	return nil
+}
+
+func (u *unixTransport) closeConnection() {
+	if u.connection != nil {
+		u.connection.Close()
+		u.connection = nil
+		u.reader = nil
+	}
+}
+
+func writeUnixFrame(w io.Writer, destination []byte, data []byte, segment bool) error {
+	size := uint32(len(data))
+	if segment {
+		size |= unixSegmentFlag
+	}
+
+	header := make([]byte, unixHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(destination)))
+	binary.BigEndian.PutUint32(header[4:], size)
+
+	buffers := net.Buffers{header, destination, data}
+	_, err := buffers.WriteTo(w)
+
+	return err
+}
+
+//Returns the destination and the data of a frame, the data being the name of a segment if passed through shared memory
+func readUnixFrame(r io.Reader, maxFrame uint32) (string, []byte, bool, error) {
+	header := make([]byte, unixHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	destinationSize := binary.BigEndian.Uint32(header)
+	dataSize := binary.BigEndian.Uint32(header[4:])
+	segment := dataSize&unixSegmentFlag != 0
+	dataSize &^= unixSegmentFlag
+	if destinationSize > maxFrame || dataSize > maxFrame {
+		return "", nil, false, fmt.Errorf("frame of %v bytes exceeds the maximum frame size of %v bytes", dataSize, maxFrame)
+	}
+
+	//The data are read straight into their own buffer, bypassing the reader buffer for the large ones
+	buffer := make([]byte, destinationSize+dataSize)
+	_, err = io.ReadFull(r, buffer)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	return string(buffer[:destinationSize]), buffer[destinationSize:], segment, nil
+}
+
+func unixSegmentDir() string {
+	if info, err := os.Stat(unixSharedMemoryDir); err == nil && info.IsDir() {
+		return unixSharedMemoryDir
+	}
+
+	return os.TempDir()
+}
+
+func writeUnixSegment(data []byte) (string, error) {
+	f, err := ioutil.TempFile(unixSegmentDir(), unixSegmentPattern)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return filepath.Base(f.Name()), nil
+}
+
+//Only the segments written by gosiris are read, a frame carrying a bare name.
+//The data are mapped into memory and must be released once decoded.
+func readUnixSegment(name string, maxFrame uint32) ([]byte, func(), error) {
+	if filepath.Base(name) != name || !strings.HasPrefix(name, unixSegmentPrefix) {
+		return nil, nil, fmt.Errorf("invalid shared memory segment %v", name)
+	}
+
+	f, err := os.Open(filepath.Join(unixSegmentDir(), name))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() > int64(maxFrame) {
+		return nil, nil, fmt.Errorf("segment of %v bytes exceeds the maximum frame size of %v bytes", info.Size(), maxFrame)
+	}
+
+	return mapUnixSegment(f, int(info.Size()))
+}
+
+func writeUnixBlock(w io.Writer, data []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+
+	buffers := net.Buffers{header, data}
+	_, err := buffers.WriteTo(w)
+
+	return err
+}
+
+func readUnixBlock(r io.Reader, maxFrame uint32) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrame {
+		return nil, fmt.Errorf("block of %v bytes exceeds the maximum frame size of %v bytes", size, maxFrame)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+
+	return data, err
+}
+
+func startUnixServer(path string, maxFrame uint32, destination string) (*unixServer, error) {
+	unixServersMutex.Lock()
+	defer unixServersMutex.Unlock()
+
+	s, exists := unixServers[path]
+	if !exists {
+		l, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s = &unixServer{
+			path:         path,
+			listener:     l,
+			maxFrame:     maxFrame,
+			destinations: make(map[string]int),
+			mailboxes:    make(map[string]*remoteMailbox),
+			connections:  make(map[net.Conn]struct{}),
+		}
+		unixServers[path] = s
+
+		go s.serve()
+
+		InfoLogger.Printf("Unix domain socket server listening on %v", path)
+	}
+
+	s.mutex.Lock()
+	if s.destinations[destination] == 0 {
+		s.mailboxes[destination] = newRemoteMailbox()
+	}
+	s.destinations[destination]++
+	s.mutex.Unlock()
+
+	return s, nil
+}
+
+//A socket file left by a crashed process is removed if nobody accepts connections on it anymore
+func listenUnix(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err == nil {
+		return l, nil
+	}
+
+	if _, statErr := os.Stat(path); statErr != nil {
+		return nil, err
+	}
+
+	c, dialErr := net.Dial("unix", path)
+	if dialErr == nil {
+		c.Close()
+		return nil, err
+	}
+
+	InfoLogger.Printf("Removing the stale socket %v", path)
+	os.Remove(path)
+
+	return net.Listen("unix", path)
+}
+
+func (s *unixServer) release(destination string) {
+	unixServersMutex.Lock()
+	defer unixServersMutex.Unlock()
+
+	s.mutex.Lock()
+	s.destinations[destination]--
+	if s.destinations[destination] <= 0 {
+		delete(s.destinations, destination)
+		if m, exists := s.mailboxes[destination]; exists {
+			m.close()
+			delete(s.mailboxes, destination)
+		}
+	}
+	empty := len(s.destinations) == 0
+	connections := s.connections
+	if empty {
+		s.connections = make(map[net.Conn]struct{})
+		s.closed = true
+	}
+	s.mutex.Unlock()
+
+	if empty {
+		s.listener.Close()
+		for c := range connections {
+			c.Close()
+		}
+		delete(unixServers, s.path)
+		InfoLogger.Printf("Unix domain socket server %v stopped", s.path)
+	}
+}
+
+func (s *unixServer) mailbox(destination string) (*remoteMailbox, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, exists := s.mailboxes[destination]
+	return m, exists
+}
+
+func (s *unixServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			InfoLogger.Printf("Unix domain socket server %v no longer accepting: %v", s.path, err)
+			return
+		}
+
+		//The connections are closed with the server
+		s.mutex.Lock()
+		closed := s.closed
+		if !closed {
+			s.connections[c] = struct{}{}
+		}
+		s.mutex.Unlock()
+		if closed {
+			c.Close()
+			return
+		}
+
+		go s.handle(c)
+	}
+}
+
+func (s *unixServer) handle(c net.Conn) {
+	defer func() {
+		c.Close()
+
+		s.mutex.Lock()
+		delete(s.connections, c)
+		s.mutex.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		destination, data, segment, err := readUnixFrame(r, s.maxFrame)
+		if err != nil {
+			if err != io.EOF {
+				ErrorLogger.Printf("Error while reading from the socket %v: %v", s.path, err)
+			}
+			return
+		}
+
+		var ack string
+		m, exists := s.mailbox(destination)
+		if !exists {
+			ack = fmt.Sprintf("destination %v not served by %v", destination, s.path)
+		} else {
+			release := func() {}
+			if segment {
+				data, release, err = readUnixSegment(string(data), s.maxFrame)
+			}
+
+			msg := EmptyContext
+			if err == nil {
+				err = json.Unmarshal(data, &msg)
+				release()
+			}
+			if err == nil {
+				InfoLogger.Printf("New Unix domain socket message received: %v", msg)
+				err = m.post(msg)
+			}
+			if err != nil {
+				ack = err.Error()
+			}
+		}
+
+		err = writeUnixBlock(c, []byte(ack))
+		if err != nil {
+			ErrorLogger.Printf("Error while acknowledging a message on the socket %v: %v", s.path, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package gosiris
+
+import (
+	"os"
+	"syscall"
+)
+
+//Maps a segment into memory so that the message is decoded without being copied
+func mapUnixSegment(f *os.File, size int) ([]byte, func(), error) {
+	if size == 0 {
+		return nil, func() {}, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() {
+		syscall.Munmap(data)
+	}, nil
+}
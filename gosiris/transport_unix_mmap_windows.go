@@ -0,0 +1,16 @@
+package gosiris
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+//Segments are read, memory mapped files not being used on Windows
+func mapUnixSegment(f *os.File, size int) ([]byte, func(), error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() {}, nil
+}
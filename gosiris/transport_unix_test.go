@@ -0,0 +1,172 @@
+package gosiris
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnix(t *testing.T) {
+	t.Log("Starting Unix domain socket test")
+
+	socket := "unix://" + filepath.Join(t.TempDir(), "gosiris.sock")
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	received := make(chan interface{}, 1)
+	actor := new(Actor).React("context", func(context Context) {
+		received <- context.Data
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("unixActor", actor, new(ActorOptions).SetRemote(true).SetRemoteType(Unix).SetUrl(socket).SetDestination("unixActor"))
+	time.Sleep(100 * time.Millisecond)
+
+	actorRef, _ := ActorSystem().ActorOf("unixActor")
+	large := strings.Repeat("x", 1<<20)
+	err := actorRef.Tell(EmptyContext, "context", large, actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if data != large {
+			t.Errorf("Unexpected data of %v bytes", len(data.(string)))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+	}
+
+	transport := newUnixTransport()
+	transport.Configure(socket, nil)
+	defer transport.Close()
+	err = transport.Send("unknown", []byte("{}"))
+	if err == nil {
+		t.Errorf("Unserved destination expected to be rejected")
+	}
+
+	transport.Configure(socket, map[string]string{UnixMaxFrame: "16"})
+	err = transport.Send("unixActor", make([]byte, 17))
+	if err == nil {
+		t.Errorf("Message larger than the maximum frame expected to be rejected")
+	}
+}
+
+func TestSharedMemory(t *testing.T) {
+	t.Log("Starting shared memory test")
+
+	socket := "shm://" + filepath.Join(t.TempDir(), "gosiris.sock")
+
+	InitActorSystem(SystemOptions{})
+	defer CloseActorSystem()
+
+	received := make(chan interface{}, 1)
+	actor := new(Actor).React("context", func(context Context) {
+		received <- context.Data
+	}).React("failure", func(context Context) {
+		panic("failure")
+	})
+	defer actor.Close()
+	ActorSystem().RegisterActor("shmActor", actor, new(ActorOptions).SetRemote(true).SetRemoteType(SharedMemory).SetUrl(socket).SetDestination("shmActor"))
+	time.Sleep(100 * time.Millisecond)
+
+	segments, _ := filepath.Glob(filepath.Join(unixSegmentDir(), unixSegmentPattern))
+
+	actorRef, _ := ActorSystem().ActorOf("shmActor")
+	large := strings.Repeat("x", 1<<20)
+	err := actorRef.Tell(EmptyContext, "context", large, actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if data != large {
+			t.Errorf("Unexpected data of %v bytes", len(data.(string)))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received")
+	}
+
+	//A failed invocation does not stop the receive loop of the actor
+	err = actorRef.Tell(EmptyContext, "failure", nil, actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actorRef.Tell(EmptyContext, "context", "after failure", actorRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if data != "after failure" {
+			t.Errorf("Unexpected data %v", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No message received after the failure")
+	}
+
+	//The segments are removed once acknowledged
+	if after, _ := filepath.Glob(filepath.Join(unixSegmentDir(), unixSegmentPattern)); len(after) > len(segments) {
+		t.Errorf("Segments left: %v", after)
+	}
+
+	_, _, err = readUnixSegment("../gosiris.sock", defaultUnixMaxFrame)
+	if err == nil {
+		t.Errorf("Segment outside of the shared memory expected to be rejected")
+	}
+}
+
+func TestUnixFrame(t *testing.T) {
+	t.Log("Starting Unix domain socket frame test")
+
+	buffer := new(bytes.Buffer)
+	writeUnixFrame(buffer, []byte("destination"), []byte("data"), false)
+
+	destination, data, segment, err := readUnixFrame(buffer, defaultUnixMaxFrame)
+	if err != nil || destination != "destination" || string(data) != "data" || segment {
+		t.Errorf("Unexpected frame %v %s: %v", destination, data, err)
+	}
+
+	writeUnixFrame(buffer, []byte("destination"), []byte("gosiris-1.seg"), true)
+	_, data, segment, err = readUnixFrame(buffer, defaultUnixMaxFrame)
+	if err != nil || string(data) != "gosiris-1.seg" || !segment {
+		t.Errorf("Unexpected segment frame %s %v: %v", data, segment, err)
+	}
+
+	writeUnixFrame(buffer, []byte("destination"), make([]byte, 32), false)
+	_, _, _, err = readUnixFrame(buffer, 16)
+	if err == nil {
+		t.Errorf("Frame larger than the maximum expected to be rejected")
+	}
+}
+
+func TestUnixRelease(t *testing.T) {
+	t.Log("Starting Unix domain socket release test")
+
+	path := filepath.Join(t.TempDir(), "gosiris.sock")
+	s, err := startUnixServer(path, defaultUnixMaxFrame, "releasedActor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	//The accepted connections are closed with the server
+	s.release("releasedActor")
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); err == nil || ok && e.Timeout() {
+		t.Errorf("Connection expected to be closed: %v", err)
+	}
+}